@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -12,7 +13,7 @@ type ErrOffsetOutOfRange struct {
 }
 
 func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
-	st := status.New(404, fmt.Sprintf("index %d out of range ", e.OffSet))
+	st := status.New(codes.NotFound, fmt.Sprintf("index %d out of range ", e.OffSet))
 	msg := fmt.Sprintf("The requested offset is outside the log's range: %d", e.OffSet)
 	d := &errdetails.LocalizedMessage{
 		Message: msg,
@@ -28,3 +29,104 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrCorruptRecord struct {
+	BaseOffset uint64
+	Position   uint64
+	Reason     string
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	return status.New(codes.DataLoss, fmt.Sprintf("corrupt record in segment %d at position %d: %s", e.BaseOffset, e.Position, e.Reason))
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOffsetCompacted struct {
+	OffSet uint64
+}
+
+func (e ErrOffsetCompacted) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("offset %d was removed by compaction", e.OffSet))
+}
+
+func (e ErrOffsetCompacted) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("topic %q does not exist", e.Topic))
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	return status.New(codes.AlreadyExists, fmt.Sprintf("topic %q already exists", e.Topic))
+}
+
+func (e ErrTopicExists) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrTopicInUse struct {
+	Topic string
+}
+
+func (e ErrTopicInUse) GRPCStatus() *status.Status {
+	return status.New(codes.FailedPrecondition, fmt.Sprintf("topic %q is in use", e.Topic))
+}
+
+func (e ErrTopicInUse) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, fmt.Sprintf("invalid topic name %q", e.Topic))
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrPartitionNotFound struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("topic %q has no partition %d", e.Topic, e.Partition))
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrNoCommittedOffset struct {
+	Group     string
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrNoCommittedOffset) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("group %q has no committed offset for topic %q partition %d", e.Group, e.Topic, e.Partition))
+}
+
+func (e ErrNoCommittedOffset) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
@@ -0,0 +1,70 @@
+// Package auth decides which clients may produce to and consume from which
+// topics.
+package auth
+
+import (
+	"fmt"
+
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ACLModel is the model used when none is given: a policy line
+// "p, subject, topic, action" allows subject to do action on topic.
+const ACLModel = `
+[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && r.obj == p.obj && r.act == p.act
+`
+
+// Authorizer checks requests against a casbin policy.
+type Authorizer struct {
+	enforcer *casbin.Enforcer
+}
+
+// New loads the casbin model and policy files, the model defaults to ACLModel
+// when modelFile is empty.
+func New(modelFile, policyFile string) (*Authorizer, error) {
+	var (
+		m   model.Model
+		err error
+	)
+	if modelFile == "" {
+		m, err = model.NewModelFromString(ACLModel)
+	} else {
+		m, err = model.NewModelFromFile(modelFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	enforcer, err := casbin.NewEnforcer(m, fileadapter.NewAdapter(policyFile))
+	if err != nil {
+		return nil, err
+	}
+	return &Authorizer{enforcer: enforcer}, nil
+}
+
+// Authorize returns a PermissionDenied status unless the policy allows subject
+// to do action on object.
+func (a *Authorizer) Authorize(subject, object, action string) error {
+	ok, err := a.enforcer.Enforce(subject, object, action)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !ok {
+		msg := fmt.Sprintf("%s not permitted to %s %s", subject, action, object)
+		return status.Error(codes.PermissionDenied, msg)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthorizer(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policy.csv")
+	policy := "p, root, orders, produce\np, root, orders, consume\np, reader, orders, consume\n"
+	require.NoError(t, os.WriteFile(policyFile, []byte(policy), 0600))
+
+	authorizer, err := New("", policyFile)
+	require.NoError(t, err)
+
+	require.NoError(t, authorizer.Authorize("root", "orders", "produce"))
+	require.NoError(t, authorizer.Authorize("reader", "orders", "consume"))
+	for _, req := range [][3]string{
+		{"reader", "orders", "produce"},
+		{"root", "payments", "consume"},
+		{"nobody", "orders", "consume"},
+	} {
+		err := authorizer.Authorize(req[0], req[1], req[2])
+		require.Equal(t, codes.PermissionDenied, status.Code(err), req)
+	}
+}
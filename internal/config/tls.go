@@ -0,0 +1,64 @@
+// Package config builds the TLS configurations servers and clients are set
+// up with.
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSConfig names the PEM files a TLS configuration is built from.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// CAFile verifies the other side, servers require every client to
+	// present a certificate it signed when it is set.
+	CAFile string
+	// ServerAddress is the name clients expect in the server's certificate.
+	ServerAddress string
+	Server        bool
+}
+
+func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CAFile != "" {
+		b, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		ca := x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("failed to parse root certificate: %q", cfg.CAFile)
+		}
+		if cfg.Server {
+			tlsConfig.ClientCAs = ca
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConfig.RootCAs = ca
+		}
+	}
+	tlsConfig.ServerName = cfg.ServerAddress
+	return tlsConfig, nil
+}
+
+// ClientCredentials returns the gRPC transport credentials of a client
+// authenticating with cfg's certificate.
+func ClientCredentials(cfg TLSConfig) (credentials.TransportCredentials, error) {
+	cfg.Server = false
+	tlsConfig, err := SetupTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
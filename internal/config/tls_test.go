@@ -0,0 +1,52 @@
+package config
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupTLSConfig(t *testing.T) {
+	caFile, certs, err := GenerateCerts(t.TempDir(), "server", "client")
+	require.NoError(t, err)
+
+	serverTLS, err := SetupTLSConfig(TLSConfig{
+		CertFile: certs["server"].CertFile,
+		KeyFile:  certs["server"].KeyFile,
+		CAFile:   caFile,
+		Server:   true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, serverTLS.ClientAuth)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	require.NoError(t, err)
+	defer ln.Close()
+	peers := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			peers <- ""
+			return
+		}
+		peers <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}()
+
+	clientTLS, err := SetupTLSConfig(TLSConfig{
+		CertFile:      certs["client"].CertFile,
+		KeyFile:       certs["client"].KeyFile,
+		CAFile:        caFile,
+		ServerAddress: "localhost",
+	})
+	require.NoError(t, err)
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientTLS)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "server", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	require.Equal(t, "client", <-peers)
+}
@@ -0,0 +1,133 @@
+// Package discovery keeps track of the nodes of a proglog cluster by gossip.
+package discovery
+
+import (
+	"log"
+	"net"
+
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/serf/serf"
+)
+
+// Common tags nodes advertise to each other.
+const (
+	RPCAddrTag = "rpc_addr"
+	RoleTag    = "role"
+)
+
+// Config describes the local node. StartJoinAddrs are the gossip addresses of
+// nodes already in the cluster, a node started without them begins a new
+// cluster.
+type Config struct {
+	NodeName       string
+	BindAddr       string
+	Tags           map[string]string
+	StartJoinAddrs []string
+}
+
+// Handler is told when other nodes join or leave the cluster.
+type Handler interface {
+	Join(name string, tags map[string]string) error
+	Leave(name string) error
+}
+
+// Membership is the local node's view of the cluster. It gossips with the
+// other nodes SWIM style and passes their joins and departures, failures
+// included, on to its handler.
+type Membership struct {
+	Config
+	handler Handler
+	serf    *serf.Serf
+	events  chan serf.Event
+}
+
+func New(handler Handler, config Config) (*Membership, error) {
+	m := &Membership{
+		Config:  config,
+		handler: handler,
+	}
+	if err := m.setupSerf(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Membership) setupSerf() error {
+	addr, err := net.ResolveTCPAddr("tcp", m.BindAddr)
+	if err != nil {
+		return err
+	}
+	config := serf.DefaultConfig()
+	config.Init()
+	config.MemberlistConfig.BindAddr = addr.IP.String()
+	config.MemberlistConfig.BindPort = addr.Port
+	m.events = make(chan serf.Event)
+	config.EventCh = m.events
+	config.Tags = m.Tags
+	config.NodeName = m.NodeName
+	m.serf, err = serf.Create(config)
+	if err != nil {
+		return err
+	}
+	go m.eventHandler()
+	if m.StartJoinAddrs != nil {
+		if _, err = m.serf.Join(m.StartJoinAddrs, true); err != nil {
+			// the caller gets no Membership to shut it down with
+			m.serf.Shutdown()
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Membership) eventHandler() {
+	for e := range m.events {
+		switch e.EventType() {
+		case serf.EventMemberJoin:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleJoin(member)
+			}
+		case serf.EventMemberLeave, serf.EventMemberFailed:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleLeave(member)
+			}
+		}
+	}
+}
+
+func (m *Membership) handleJoin(member serf.Member) {
+	// every node is told, only the raft leader changes the cluster
+	if err := m.handler.Join(member.Name, member.Tags); err != nil && err != raft.ErrNotLeader {
+		log.Printf("discovery: failed to join %s: %v", member.Name, err)
+	}
+}
+
+func (m *Membership) handleLeave(member serf.Member) {
+	if err := m.handler.Leave(member.Name); err != nil && err != raft.ErrNotLeader {
+		log.Printf("discovery: failed to leave %s: %v", member.Name, err)
+	}
+}
+
+func (m *Membership) isLocal(member serf.Member) bool {
+	return m.serf.LocalMember().Name == member.Name
+}
+
+// Members returns every node the local one knows of, itself included, with
+// its status.
+func (m *Membership) Members() []serf.Member {
+	return m.serf.Members()
+}
+
+// Leave tells the cluster the node is leaving and stops gossiping.
+func (m *Membership) Leave() error {
+	if err := m.serf.Leave(); err != nil {
+		return err
+	}
+	return m.serf.Shutdown()
+}
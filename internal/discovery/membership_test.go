@@ -0,0 +1,115 @@
+package discovery
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+func TestMembership(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 2 &&
+			len(m[0].Members()) == 3 &&
+			len(handler.leaves) == 0
+	}, 3*time.Second, 250*time.Millisecond)
+
+	join := <-handler.joins
+	require.Equal(t, "1", join.name)
+	require.Equal(t, "follower", join.tags[RoleTag])
+	require.NotEmpty(t, join.tags[RPCAddrTag])
+
+	require.NoError(t, m[2].Leave())
+	require.Eventually(t, func() bool {
+		return len(handler.joins) == 1 &&
+			len(m[0].Members()) == 3 &&
+			status(m[0], "2") == serf.StatusLeft &&
+			len(handler.leaves) == 1
+	}, 3*time.Second, 250*time.Millisecond)
+	require.Equal(t, "2", <-handler.leaves)
+}
+
+func TestMembershipJoinFails(t *testing.T) {
+	ports := dynaport.Get(2)
+	c := Config{
+		NodeName:       "0",
+		BindAddr:       fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		StartJoinAddrs: []string{fmt.Sprintf("127.0.0.1:%d", ports[1])},
+	}
+	_, err := New(&handler{}, c)
+	require.Error(t, err)
+
+	// the failed node released its address
+	c.StartJoinAddrs = nil
+	m, err := New(&handler{}, c)
+	require.NoError(t, err)
+	require.NoError(t, m.Leave())
+}
+
+func status(m *Membership, name string) serf.MemberStatus {
+	for _, member := range m.Members() {
+		if member.Name == name {
+			return member.Status
+		}
+	}
+	return serf.StatusNone
+}
+
+func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler) {
+	id := len(members)
+	ports := dynaport.Get(1)
+	addr := fmt.Sprintf("127.0.0.1:%d", ports[0])
+	tags := map[string]string{
+		RPCAddrTag: addr,
+		RoleTag:    "follower",
+	}
+	c := Config{
+		NodeName: fmt.Sprintf("%d", id),
+		BindAddr: addr,
+		Tags:     tags,
+	}
+	h := &handler{}
+	if len(members) == 0 {
+		h.joins = make(chan joined, 3)
+		h.leaves = make(chan string, 3)
+		c.Tags[RoleTag] = "leader"
+	} else {
+		c.StartJoinAddrs = []string{members[0].BindAddr}
+	}
+	m, err := New(h, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Leave() })
+	members = append(members, m)
+	return members, h
+}
+
+type joined struct {
+	name string
+	tags map[string]string
+}
+
+type handler struct {
+	joins  chan joined
+	leaves chan string
+}
+
+func (h *handler) Join(name string, tags map[string]string) error {
+	if h.joins != nil {
+		h.joins <- joined{name: name, tags: tags}
+	}
+	return nil
+}
+
+func (h *handler) Leave(name string) error {
+	if h.leaves != nil {
+		h.leaves <- name
+	}
+	return nil
+}
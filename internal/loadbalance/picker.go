@@ -0,0 +1,69 @@
+package loadbalance
+
+import (
+	"sync"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(Name, &pickerBuilder{}, base.Config{}))
+}
+
+// readMethods are served by followers, every other call goes to the leader.
+var readMethods = map[string]bool{
+	"/log.v1.log/Consume":         true,
+	"/log.v1.log/ConsumeStream":   true,
+	"/log.v1.log/Fetch":           true,
+	"/log.v1.log/OffsetsForTimes": true,
+}
+
+type pickerBuilder struct{}
+
+var _ base.PickerBuilder = (*pickerBuilder)(nil)
+
+func (b *pickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	p := &Picker{}
+	for sc, scInfo := range buildInfo.ReadySCs {
+		isLeader, _ := scInfo.Address.Attributes.Value(leaderKey{}).(bool)
+		if isLeader {
+			p.leader = sc
+			continue
+		}
+		p.followers = append(p.followers, sc)
+	}
+	return p
+}
+
+// Picker sends writes to the leader and spreads reads round-robin over the
+// followers, or over the leader when there are none.
+type Picker struct {
+	mu        sync.Mutex
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	current   uint64
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var result balancer.PickResult
+	if readMethods[info.FullMethodName] && len(p.followers) > 0 {
+		result.SubConn = p.nextFollower()
+	} else {
+		result.SubConn = p.leader
+	}
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+func (p *Picker) nextFollower() balancer.SubConn {
+	sc := p.followers[p.current%uint64(len(p.followers))]
+	p.current++
+	return sc
+}
@@ -0,0 +1,123 @@
+// Package loadbalance spreads a client's requests over the servers of a
+// proglog cluster. Dial "proglog:///<addr>", with addr any server of the
+// cluster, to send writes to the leader and reads to the followers.
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+const Name = "proglog"
+
+// leaderKey marks the address of the leader in the resolved addresses.
+type leaderKey struct{}
+
+// resolveTimeout bounds the GetServers call to a single server.
+const resolveTimeout = 5 * time.Second
+
+func init() {
+	resolver.Register(&Builder{})
+}
+
+// Builder creates a Resolver for every client connection using the proglog
+// scheme.
+type Builder struct{}
+
+var _ resolver.Builder = (*Builder)(nil)
+
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	r := &Resolver{
+		clientConn: cc,
+		servers:    []string{target.Endpoint},
+	}
+	if opts.DialCreds != nil {
+		r.dialOpts = append(r.dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
+	} else {
+		r.dialOpts = append(r.dialOpts, grpc.WithInsecure())
+	}
+	r.serviceConfig = cc.ParseServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name))
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	return r, nil
+}
+
+func (b *Builder) Scheme() string {
+	return Name
+}
+
+// Resolver finds the servers of the cluster with the GetServers RPC. gRPC asks
+// it to resolve again whenever a connection fails, so a new leader is picked
+// up after a failover.
+type Resolver struct {
+	mu            sync.Mutex
+	clientConn    resolver.ClientConn
+	dialOpts      []grpc.DialOption
+	serviceConfig *serviceconfig.ParseResult
+	// servers are asked for the cluster in turn, the dial target first and
+	// then the servers it last returned.
+	servers []string
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	servers, err := r.getServers()
+	if err != nil {
+		r.clientConn.ReportError(err)
+		return
+	}
+	var addrs []resolver.Address
+	known := []string{r.servers[0]}
+	for _, server := range servers {
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attributes.New(leaderKey{}, server.IsLeader),
+		})
+		if server.RpcAddr != known[0] {
+			known = append(known, server.RpcAddr)
+		}
+	}
+	r.servers = known
+	r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	})
+}
+
+func (r *Resolver) getServers() ([]*api.Server, error) {
+	var err error
+	for _, addr := range r.servers {
+		var servers []*api.Server
+		if servers, err = r.ask(addr); err == nil {
+			return servers, nil
+		}
+	}
+	return nil, err
+}
+
+func (r *Resolver) ask(addr string) ([]*api.Server, error) {
+	conn, err := grpc.Dial(addr, r.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	res, err := api.NewLogClient(conn).GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		return nil, err
+	}
+	return res.Servers, nil
+}
+
+func (r *Resolver) Close() {}
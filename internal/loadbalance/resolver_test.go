@@ -0,0 +1,184 @@
+package loadbalance_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"github.com/abdelwhab-1/proglog/internal/loadbalance"
+	"github.com/abdelwhab-1/proglog/internal/log"
+	"github.com/abdelwhab-1/proglog/internal/server"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func TestResolver(t *testing.T) {
+	cluster := &getServers{}
+	var logs []server.CommitLog
+	var servers []*grpc.Server
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "loadbalance-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		clog, err := log.NewLog(dir, log.Config{})
+		require.NoError(t, err)
+		defer clog.Close()
+		// every server holds a record telling it apart
+		_, err = clog.Append(&api.Record{Value: []byte(fmt.Sprintf("%d", i))})
+		require.NoError(t, err)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		srv, err := server.NewGRPCServer(&server.Config{CommitLog: clog, GetServerer: cluster})
+		require.NoError(t, err)
+		go srv.Serve(l)
+		defer srv.Stop()
+
+		cluster.servers = append(cluster.servers, &api.Server{
+			Id:       fmt.Sprintf("%d", i),
+			RpcAddr:  l.Addr().String(),
+			IsLeader: i == 0,
+		})
+		logs = append(logs, clog)
+		servers = append(servers, srv)
+	}
+
+	target := fmt.Sprintf("%s:///%s", loadbalance.Name, cluster.servers[0].RpcAddr)
+	conn, err := grpc.Dial(target, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+	ctx := context.Background()
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("to the leader")}})
+	require.NoError(t, err)
+	record, err := logs[0].Read(produce.OffSet)
+	require.NoError(t, err)
+	require.Equal(t, []byte("to the leader"), record.Value)
+
+	// reads are spread over both followers
+	seen := map[string]bool{}
+	require.Eventually(t, func() bool {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{OffSet: 0})
+		require.NoError(t, err)
+		seen[string(consume.Record.Value)] = true
+		return seen["1"] && seen["2"]
+	}, 3*time.Second, 10*time.Millisecond)
+	require.False(t, seen["0"])
+
+	// the leader fails and the second server takes over
+	cluster.failover()
+	servers[0].Stop()
+	require.Eventually(t, func() bool {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		produce, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("to the new leader")}})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	record, err = logs[1].Read(produce.OffSet)
+	require.NoError(t, err)
+	require.Equal(t, []byte("to the new leader"), record.Value)
+}
+
+func TestResolverDistributedLog(t *testing.T) {
+	var logs []*log.DistributedLog
+	var raftAddrs, rpcAddrs []string
+	for i := 0; i < 3; i++ {
+		raftLn, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		rpcLn, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := log.Config{}
+		config.Raft.StreamLayer = log.NewStreamLayer(raftLn, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+		config.Raft.RPCAddr = rpcLn.Addr().String()
+		dlog, err := log.NewDistributedLog(t.TempDir(), config)
+		require.NoError(t, err)
+		defer dlog.Close()
+		if i == 0 {
+			require.NoError(t, dlog.WaitForLeader(3*time.Second))
+		}
+
+		srv, err := server.NewGRPCServer(&server.Config{CommitLog: dlog, GetServerer: dlog})
+		require.NoError(t, err)
+		go srv.Serve(rpcLn)
+		defer srv.Stop()
+
+		// every node is told of every other one, as discovery does, and
+		// only the leader adds it to the cluster
+		for j, other := range logs {
+			err := other.Join(fmt.Sprintf("%d", i), raftLn.Addr().String(), config.Raft.RPCAddr)
+			if j == 0 {
+				require.NoError(t, err)
+			} else {
+				require.Equal(t, raft.ErrNotLeader, err)
+			}
+			require.Equal(t, raft.ErrNotLeader, dlog.Join(fmt.Sprintf("%d", j), raftAddrs[j], rpcAddrs[j]))
+		}
+		logs = append(logs, dlog)
+		raftAddrs = append(raftAddrs, raftLn.Addr().String())
+		rpcAddrs = append(rpcAddrs, config.Raft.RPCAddr)
+	}
+
+	// the resolver learns the cluster from a follower
+	target := fmt.Sprintf("%s:///%s", loadbalance.Name, rpcAddrs[2])
+	conn, err := grpc.Dial(target, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+	client := api.NewLogClient(conn)
+	ctx := context.Background()
+
+	// followers refuse appends, so the produce reaching the log means it
+	// was sent to the leader's gRPC address
+	var produce *api.ProduceResponse
+	require.Eventually(t, func() bool {
+		produce, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("replicated")}})
+		return err == nil
+	}, 3*time.Second, 10*time.Millisecond)
+	for _, dlog := range logs {
+		require.Eventually(t, func() bool {
+			_, err := dlog.Read(produce.OffSet)
+			return err == nil
+		}, 3*time.Second, 10*time.Millisecond)
+	}
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{OffSet: produce.OffSet})
+	require.NoError(t, err)
+	require.Equal(t, []byte("replicated"), consume.Record.Value)
+}
+
+// getServers is the membership of a fake cluster shared by its servers.
+type getServers struct {
+	mu      sync.Mutex
+	servers []*api.Server
+}
+
+func (g *getServers) GetServers() ([]*api.Server, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var servers []*api.Server
+	for _, srv := range g.servers {
+		servers = append(servers, &api.Server{Id: srv.Id, RpcAddr: srv.RpcAddr, IsLeader: srv.IsLeader})
+	}
+	return servers, nil
+}
+
+// failover drops the leader, the next server takes over.
+func (g *getServers) failover() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.servers = g.servers[1:]
+	g.servers[0].IsLeader = true
+}
@@ -0,0 +1,59 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecs(t *testing.T) {
+	want := bytes.Repeat([]byte(`{"level":"info","msg":"hello world"}`), 16)
+	for _, codec := range []Codec{CodecGzip, CodecSnappy, CodecZstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			comp, err := codec.compressor()
+			require.NoError(t, err)
+			compressed, err := comp.Compress(want)
+			require.NoError(t, err)
+			require.True(t, len(compressed) < len(want))
+			got, err := comp.Decompress(compressed)
+			require.NoError(t, err)
+			require.Equal(t, want, got)
+		})
+	}
+	_, err := Codec(42).compressor()
+	require.Error(t, err)
+}
+
+func TestStoreMixedCodecs(t *testing.T) {
+	file, err := ioutil.TempFile("", "store_codec_test")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	store, err := NewStore(file)
+	require.NoError(t, err)
+
+	verbose := bytes.Repeat([]byte(`{"level":"info","msg":"hello world"}`), 16)
+	var positions []uint64
+	for _, codec := range []Codec{CodecNone, CodecGzip, CodecSnappy, CodecZstd} {
+		store.codec = codec
+		_, pos, err := store.Append(verbose)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	// too small to shrink, stored uncompressed
+	_, pos, err := store.Append(write)
+	require.NoError(t, err)
+	require.True(t, store.rawSize > store.size)
+
+	store.codec = CodecNone
+	for _, pos := range positions {
+		got, err := store.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, verbose, got)
+	}
+	got, err := store.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, got)
+}
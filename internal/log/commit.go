@@ -0,0 +1,117 @@
+package log
+
+import (
+	"sync"
+	"time"
+)
+
+// groupCommitter batches fsyncs for DurabilityGroup. Records are numbered in
+// the order they are written and synced is the highest number known to be on
+// disk.
+type groupCommitter struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	written    uint64
+	synced     uint64
+	syncing    bool
+	closed     bool
+	err        error
+	timer      *time.Timer
+	maxRecords uint64
+	interval   time.Duration
+	// sync makes every record written so far durable and returns the
+	// number of the last one.
+	sync func() (uint64, error)
+}
+
+func newGroupCommitter(maxRecords uint64, interval time.Duration, syncFn func() (uint64, error)) *groupCommitter {
+	c := &groupCommitter{
+		maxRecords: maxRecords,
+		interval:   interval,
+		sync:       syncFn,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// add registers n newly written records and returns the number of the last
+// one, the caller must hold the log lock so that the numbering follows the
+// order in the store.
+func (c *groupCommitter) add(n uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written += n
+	if c.timer == nil && !c.closed {
+		c.timer = time.AfterFunc(c.interval, c.tick)
+	}
+	return c.written
+}
+
+func (c *groupCommitter) lastWritten() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written
+}
+
+// wait blocks until the record numbered seq has been synced.
+func (c *groupCommitter) wait(seq uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.synced < seq && c.err == nil {
+		if !c.syncing && c.maxRecords > 0 && c.written-c.synced >= c.maxRecords {
+			c.runSync()
+			continue
+		}
+		c.cond.Wait()
+	}
+	if c.synced >= seq {
+		return nil
+	}
+	return c.err
+}
+
+func (c *groupCommitter) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	if !c.syncing && c.synced < c.written {
+		c.runSync()
+	}
+}
+
+// runSync must be called with c.mu held, the lock is released while the
+// sync is running so that new records can keep joining the next group.
+func (c *groupCommitter) runSync() {
+	c.syncing = true
+	c.mu.Unlock()
+	seq, err := c.sync()
+	c.mu.Lock()
+	c.syncing = false
+	if err != nil {
+		c.err = err
+	} else if seq > c.synced {
+		c.synced = seq
+	}
+	if c.synced < c.written && c.timer == nil && !c.closed {
+		c.timer = time.AfterFunc(c.interval, c.tick)
+	}
+	c.cond.Broadcast()
+}
+
+// close syncs whatever is still pending and stops the timer.
+func (c *groupCommitter) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	for c.syncing {
+		c.cond.Wait()
+	}
+	if c.synced < c.written && c.err == nil {
+		c.runSync()
+	}
+	return c.err
+}
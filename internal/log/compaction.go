@@ -0,0 +1,271 @@
+package log
+
+import (
+	"os"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// compactedSuffix marks the files a segment is rewritten into, leftovers from
+// a crash in the middle of a rewrite are removed by setup.
+const compactedSuffix = ".compacted"
+
+// compact rewrites the closed segments so that they only hold the latest
+// record of every key, tombstones are dropped once their segment is older than
+// the grace period. Offsets never change, reading a removed one returns
+// api.ErrOffsetCompacted. The segments are scanned and rewritten under the
+// read lock, readers and writers only wait for the rewritten ones to be
+// swapped in.
+func (log *log) compact(now time.Time) error {
+	log.mu.RLock()
+	compactions, err := log.rewriteSegments(now)
+	log.mu.RUnlock()
+	if err != nil {
+		for _, c := range compactions {
+			c.discard()
+		}
+		return err
+	}
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.swapSegments(compactions)
+}
+
+// rewriteSegments writes the compacted files of every closed segment that has
+// records to drop. It is called with the read lock held.
+func (log *log) rewriteSegments(now time.Time) ([]*compaction, error) {
+	latest := make(map[string]uint64)
+	for _, seg := range log.segments {
+		err := seg.scan(func(record *api.Record) {
+			if record.Key != nil {
+				latest[string(record.Key)] = record.Offset
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var compactions []*compaction
+	for _, seg := range log.segments[:len(log.segments)-1] {
+		info, err := seg.Store.File.Stat()
+		if err != nil {
+			return compactions, err
+		}
+		expired := now.Sub(info.ModTime()) > log.Config.Compaction.TombstoneGrace
+		var keep []*api.Record
+		total := 0
+		err = seg.scan(func(record *api.Record) {
+			total++
+			if record.Key == nil {
+				keep = append(keep, record)
+				return
+			}
+			if latest[string(record.Key)] != record.Offset {
+				return
+			}
+			if len(record.Value) == 0 && expired {
+				return
+			}
+			keep = append(keep, record)
+		})
+		if err != nil {
+			return compactions, err
+		}
+		if len(keep) == total {
+			continue
+		}
+		c, err := seg.rewrite(keep, info.ModTime())
+		if err != nil {
+			return compactions, err
+		}
+		compactions = append(compactions, c)
+	}
+	return compactions, nil
+}
+
+// swapSegments swaps the rewritten segments in, those retention removed or
+// TruncateFrom cut since are left alone. It is called with the write lock
+// held.
+func (log *log) swapSegments(compactions []*compaction) error {
+	for j, c := range compactions {
+		i := log.indexOf(c.seg)
+		if i < 0 || !c.current() {
+			c.discard()
+			continue
+		}
+		compacted, err := c.swap(log.Dir)
+		if err != nil {
+			for _, c := range compactions[j+1:] {
+				c.discard()
+			}
+			return err
+		}
+		log.segments[i] = compacted
+	}
+	return nil
+}
+
+func (log *log) indexOf(seg *segment) int {
+	for i, s := range log.segments {
+		if s == seg {
+			return i
+		}
+	}
+	return -1
+}
+
+// scan calls fn with every record of the segment in offset order.
+func (seg *segment) scan(fn func(*api.Record)) error {
+	for i := int64(0); uint64(i) < seg.Index.size/entWidth; i++ {
+		_, pos, err := seg.Index.Read(i)
+		if err != nil {
+			return err
+		}
+		b, err := seg.Store.Read(pos)
+		if err != nil {
+			if corrupt, ok := err.(api.ErrCorruptRecord); ok {
+				corrupt.BaseOffset = seg.baseOffset
+				return corrupt
+			}
+			return err
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(b, record); err != nil {
+			return err
+		}
+		fn(record)
+	}
+	return nil
+}
+
+// compaction is a segment rewritten into its .compacted files, waiting to be
+// swapped in.
+type compaction struct {
+	seg *segment
+	// the segment's end when it was rewritten
+	storeSize, nextOffset uint64
+	modTime               time.Time
+	times                 timeIndexer
+	rawSize               uint64
+}
+
+// rewrite writes files holding only records next to the segment's own. They
+// are complete before swap renames them over the old ones, and keep the old
+// modification time so that retention and the tombstone grace period are not
+// reset.
+func (seg *segment) rewrite(records []*api.Record, modTime time.Time) (*compaction, error) {
+	storeName := seg.Store.File.Name()
+	indexName := seg.Index.Name()
+	timeIndexName := seg.TimeIndex.Name()
+	storeFile, err := os.OpenFile(storeName+compactedSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store, err := NewStore(storeFile)
+	if err != nil {
+		return nil, err
+	}
+	store.codec = seg.conf.Sagment.Codec
+	idxFile, err := os.OpenFile(indexName+compactedSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := newIndex(idxFile, seg.conf)
+	if err != nil {
+		return nil, err
+	}
+	timeIdxFile, err := os.OpenFile(timeIndexName+compactedSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	timeIdx, err := newTimeIndex(timeIdxFile, seg.conf)
+	if err != nil {
+		return nil, err
+	}
+	times := timeIndexer{interval: seg.conf.Sagment.TimeIndexIntervalBytes}
+	for _, record := range records {
+		b, err := proto.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		_, pos, err := store.Append(b)
+		if err != nil {
+			return nil, err
+		}
+		rel := uint32(record.Offset - seg.baseOffset)
+		if err := idx.Write(pos, rel); err != nil {
+			return nil, err
+		}
+		if times.observe(record.Timestamp, pos) {
+			if err := timeIdx.Write(record.Timestamp, rel); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := store.Sync(); err != nil {
+		return nil, err
+	}
+	if err := store.Close(); err != nil {
+		return nil, err
+	}
+	if err := idx.Close(); err != nil {
+		return nil, err
+	}
+	if err := timeIdx.Close(); err != nil {
+		return nil, err
+	}
+	return &compaction{
+		seg:        seg,
+		storeSize:  seg.Store.size,
+		nextOffset: seg.nextOffset,
+		modTime:    modTime,
+		times:      times,
+		rawSize:    store.rawSize,
+	}, nil
+}
+
+// current reports whether the segment still ends where it did when it was
+// rewritten.
+func (c *compaction) current() bool {
+	return c.seg.Store.size == c.storeSize && c.seg.nextOffset == c.nextOffset
+}
+
+// swap renames the compacted files over the segment's and returns it
+// reopened. It is called with the write lock held.
+func (c *compaction) swap(dir string) (*segment, error) {
+	seg := c.seg
+	storeName := seg.Store.File.Name()
+	indexName := seg.Index.Name()
+	timeIndexName := seg.TimeIndex.Name()
+	if err := seg.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(storeName+compactedSuffix, storeName); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(indexName+compactedSuffix, indexName); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(timeIndexName+compactedSuffix, timeIndexName); err != nil {
+		return nil, err
+	}
+	if err := os.Chtimes(storeName, c.modTime, c.modTime); err != nil {
+		return nil, err
+	}
+	compacted, err := newSegment(dir, seg.baseOffset, seg.conf)
+	if err != nil {
+		return nil, err
+	}
+	compacted.times = c.times
+	compacted.Store.rawSize = c.rawSize
+	return compacted, nil
+}
+
+// discard removes the compacted files, setup removes them too if this fails.
+func (c *compaction) discard() {
+	for _, name := range []string{c.seg.Store.File.Name(), c.seg.Index.Name(), c.seg.TimeIndex.Name()} {
+		os.Remove(name + compactedSuffix)
+	}
+}
@@ -1,9 +1,76 @@
 package log
 
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
 type Config struct {
+	// Raft configures the consensus of a DistributedLog, the other log
+	// types ignore it.
+	Raft struct {
+		raft.Config
+		StreamLayer *StreamLayer
+		// Bootstrap starts a new cluster with this node as its only
+		// member, the others join it through the leader.
+		Bootstrap bool
+		// RPCAddr is the address the node serves gRPC on, GetServers
+		// publishes it instead of the raft address.
+		RPCAddr string
+	}
 	Sagment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// TimeIndexIntervalBytes is the minimum amount of store written
+		// between two entries of the sparse time index.
+		TimeIndexIntervalBytes uint64
+		// Codec compresses the records appended from now on, frames record
+		// their own codec so older ones stay readable.
+		Codec Codec
+	}
+	Durability struct {
+		Mode Durability
+		// MaxRecords and Interval bound a group commit, a sync happens as
+		// soon as either is reached. Only used with DurabilityGroup.
+		MaxRecords uint64
+		Interval   time.Duration
+	}
+	Retention struct {
+		// MaxBytes bounds the total size of the stores and MaxAge the time
+		// since a segment was last written to, zero disables either rule.
+		MaxBytes uint64
+		MaxAge   time.Duration
+		// MinSegments is the number of segments, the active one included,
+		// that are kept whatever the other rules say.
+		MinSegments int
+		// CheckInterval is how often the cleaner looks for segments to drop.
+		CheckInterval time.Duration
+	}
+	Compaction struct {
+		// Enabled keeps only the latest record for every key in the closed
+		// segments, records without a key are never compacted.
+		Enabled bool
+		// TombstoneGrace is how long a record with a key and no value is
+		// kept after its segment was last written to, so that consumers get
+		// to see the deletion.
+		TombstoneGrace time.Duration
+		Interval       time.Duration
 	}
 }
+
+// Durability selects when an appended record has to reach the disk before
+// Append returns its offset.
+type Durability int
+
+const (
+	// DurabilityOS writes every record to the store file and leaves it to
+	// the operating system to decide when it is flushed to disk.
+	DurabilityOS Durability = iota
+	// DurabilitySync fsyncs the store on every append.
+	DurabilitySync
+	// DurabilityGroup shares one fsync between all records appended within
+	// a group, every appender waits for the sync covering its record.
+	DurabilityGroup
+)
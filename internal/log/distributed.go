@@ -0,0 +1,726 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+// DistributedLog is a log replicated to a cluster of nodes. Appends go through
+// raft and return once a quorum has committed them, reads are served by the
+// node's local copy.
+type DistributedLog struct {
+	config Config
+	log    *log
+	// raftLog and stable are the raft log and stable store, they are kept
+	// in segments like the records themselves.
+	raftLog *logStore
+	stable  *stableStore
+	raft    *raft.Raft
+
+	// mu orders the appends of the leader: next is the offset it gives the
+	// next record and is only trusted while synced, which a change of leader
+	// clears.
+	mu            sync.Mutex
+	next          uint64
+	synced        bool
+	leaderChanges chan raft.Observation
+	observer      *raft.Observer
+
+	// rpcAddrs maps the ID of every known server to its gRPC address.
+	rpcMu    sync.Mutex
+	rpcAddrs map[raft.ServerID]string
+}
+
+func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
+	l := &DistributedLog{
+		config:   config,
+		rpcAddrs: map[raft.ServerID]string{config.Raft.LocalID: config.Raft.RPCAddr},
+	}
+	if err := l.setupLog(dataDir); err != nil {
+		return nil, err
+	}
+	if err := l.setupRaft(dataDir); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *DistributedLog) setupLog(dataDir string) error {
+	logDir := filepath.Join(dataDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	var err error
+	l.log, err = NewLog(logDir, l.config)
+	return err
+}
+
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	fsm := &fsm{log: l.log}
+
+	logDir := filepath.Join(dataDir, "raft", "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	// only the segment sizes carry over: raft needs its entries on disk
+	// before they are acknowledged and removes them itself once they are
+	// in a snapshot, so neither retention nor compaction may touch them
+	var logConfig Config
+	logConfig.Sagment = l.config.Sagment
+	// raft log indexes start at 1
+	logConfig.Sagment.InitialOffset = 1
+	logConfig.Durability.Mode = DurabilitySync
+	raftLog, err := NewLog(logDir, logConfig)
+	if err != nil {
+		return err
+	}
+	l.raftLog = &logStore{raftLog}
+
+	stableDir := filepath.Join(dataDir, "raft", "stable")
+	if err := os.MkdirAll(stableDir, 0755); err != nil {
+		return err
+	}
+	if l.stable, err = newStableStore(stableDir); err != nil {
+		return err
+	}
+
+	retain := 1
+	snapshotStore, err := raft.NewFileSnapshotStore(filepath.Join(dataDir, "raft"), retain, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	maxPool := 5
+	timeout := 10 * time.Second
+	transport := raft.NewNetworkTransport(l.config.Raft.StreamLayer, maxPool, timeout, os.Stderr)
+
+	config := raft.DefaultConfig()
+	config.LocalID = l.config.Raft.LocalID
+	if l.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	}
+	if l.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	}
+	if l.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	}
+	if l.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = l.config.Raft.CommitTimeout
+	}
+
+	l.raft, err = raft.NewRaft(config, fsm, l.raftLog, l.stable, snapshotStore, transport)
+	if err != nil {
+		return err
+	}
+	l.leaderChanges = make(chan raft.Observation, 1)
+	l.observer = raft.NewObserver(l.leaderChanges, false, func(o *raft.Observation) bool {
+		_, ok := o.Data.(raft.LeaderObservation)
+		return ok
+	})
+	l.raft.RegisterObserver(l.observer)
+	hasState, err := raft.HasExistingState(l.raftLog, l.stable, snapshotStore)
+	if err != nil {
+		return err
+	}
+	if l.config.Raft.Bootstrap && !hasState {
+		config := raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: transport.LocalAddr(),
+			}},
+		}
+		err = l.raft.BootstrapCluster(config).Error()
+	}
+	return err
+}
+
+type requestType uint8
+
+const (
+	appendRequestType requestType = iota
+	appendBatchRequestType
+)
+
+type batchResponse struct {
+	first, last uint64
+}
+
+// Append replicates the record and returns its offset once a quorum of the
+// cluster has committed it. Only the leader accepts appends.
+func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	res, err := l.apply(appendRequestType, []*api.Record{record}, &api.ProduceRequest{Record: record})
+	if err != nil {
+		return 0, err
+	}
+	return res.(uint64), nil
+}
+
+// AppendBatch replicates the records as a single raft entry, so they are
+// committed all together or not at all.
+func (l *DistributedLog) AppendBatch(records []*api.Record) (uint64, uint64, error) {
+	if len(records) == 0 {
+		return 0, 0, ErrEmptyBatch
+	}
+	res, err := l.apply(appendBatchRequestType, records, &api.ProduceBatchRequest{Records: records})
+	if err != nil {
+		return 0, 0, err
+	}
+	batch := res.(batchResponse)
+	return batch.first, batch.last, nil
+}
+
+const applyTimeout = 10 * time.Second
+
+// apply stamps the records of req and replicates it. The lock is held until
+// raft has the entry, so that entries are in the order of their offsets.
+func (l *DistributedLog) apply(reqType requestType, records []*api.Record, req proto.Message) (interface{}, error) {
+	l.mu.Lock()
+	if err := l.stamp(records); err != nil {
+		l.mu.Unlock()
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(byte(reqType))
+	b, err := proto.Marshal(req)
+	if err != nil {
+		l.mu.Unlock()
+		return nil, err
+	}
+	buf.Write(b)
+	future := l.raft.Apply(buf.Bytes(), applyTimeout)
+	l.mu.Unlock()
+
+	err = future.Error()
+	if err == nil {
+		if resErr, ok := future.Response().(error); ok {
+			err = resErr
+		}
+	}
+	if err != nil {
+		// the offsets may have been taken, resync before the next append
+		l.mu.Lock()
+		l.synced = false
+		l.mu.Unlock()
+		return nil, err
+	}
+	return future.Response(), nil
+}
+
+// stamp gives the records their offsets and append time on the leader, every
+// replica then writes them as they are. After a change of leader the offsets
+// are picked up from the local log once it has applied every entry before a
+// barrier. It is called with mu held.
+func (l *DistributedLog) stamp(records []*api.Record) error {
+drain:
+	for {
+		select {
+		case <-l.leaderChanges:
+			l.synced = false
+		default:
+			break drain
+		}
+	}
+	if !l.synced {
+		if err := l.raft.Barrier(applyTimeout).Error(); err != nil {
+			return err
+		}
+		l.next = l.log.nextOffset()
+		l.synced = true
+	}
+	now := time.Now().UnixNano()
+	for _, record := range records {
+		record.Offset = l.next
+		record.Timestamp = now
+		l.next++
+	}
+	return nil
+}
+
+// Read returns the record from the local copy, a follower may not have it
+// yet.
+func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
+	return l.log.Read(offset)
+}
+
+func (l *DistributedLog) ReadBatch(offset uint64, max int, maxBytes uint64) ([]*api.Record, error) {
+	return l.log.ReadBatch(offset, max, maxBytes)
+}
+
+func (l *DistributedLog) LowestOffset() (uint64, error) {
+	return l.log.LowestOffset()
+}
+
+func (l *DistributedLog) HighestOffset() (uint64, error) {
+	return l.log.HighestOffset()
+}
+
+func (l *DistributedLog) OffsetForTime(t time.Time) (uint64, error) {
+	return l.log.OffsetForTime(t)
+}
+
+func (l *DistributedLog) Wait(ctx context.Context, offset uint64) error {
+	return l.log.Wait(ctx, offset)
+}
+
+// Join records the gRPC address of the server and adds it to the cluster at
+// its raft address, it is a no-op when the server is already a member at the
+// same address. Every node is told of every server so that any of them can
+// answer GetServers, only the leader changes the cluster and the others
+// return raft.ErrNotLeader once they have recorded the address.
+func (l *DistributedLog) Join(id, addr, rpcAddr string) error {
+	serverID := raft.ServerID(id)
+	l.rpcMu.Lock()
+	l.rpcAddrs[serverID] = rpcAddr
+	l.rpcMu.Unlock()
+	if l.raft.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			if srv.ID == serverID && srv.Address == serverAddr {
+				return nil
+			}
+			// remove the stale server
+			removeFuture := l.raft.RemoveServer(srv.ID, 0, 0)
+			if err := removeFuture.Error(); err != nil {
+				return err
+			}
+		}
+	}
+	return l.raft.AddVoter(serverID, serverAddr, 0, 0).Error()
+}
+
+// Leave removes the server from the cluster.
+func (l *DistributedLog) Leave(id string) error {
+	l.rpcMu.Lock()
+	delete(l.rpcAddrs, raft.ServerID(id))
+	l.rpcMu.Unlock()
+	if l.raft.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+	return l.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+// GetServers returns the members of the cluster with the gRPC address they
+// joined with, the members whose address this node wasn't told of are left
+// out.
+func (l *DistributedLog) GetServers() ([]*api.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	leader, _ := l.raft.LeaderWithID()
+	l.rpcMu.Lock()
+	defer l.rpcMu.Unlock()
+	var servers []*api.Server
+	for _, server := range future.Configuration().Servers {
+		rpcAddr := l.rpcAddrs[server.ID]
+		if rpcAddr == "" {
+			continue
+		}
+		servers = append(servers, &api.Server{
+			Id:       string(server.ID),
+			RpcAddr:  rpcAddr,
+			IsLeader: leader == server.Address,
+		})
+	}
+	return servers, nil
+}
+
+// WaitForLeader blocks until the cluster has elected a leader or the timeout
+// expires.
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out waiting for a leader")
+		case <-ticker.C:
+			if addr, _ := l.raft.LeaderWithID(); addr != "" {
+				return nil
+			}
+		}
+	}
+}
+
+func (l *DistributedLog) Close() error {
+	l.raft.DeregisterObserver(l.observer)
+	if err := l.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if err := l.raftLog.Close(); err != nil {
+		return err
+	}
+	if err := l.stable.Close(); err != nil {
+		return err
+	}
+	return l.log.Close()
+}
+
+var _ raft.FSM = (*fsm)(nil)
+
+// fsm applies the committed entries to the local log.
+type fsm struct {
+	log *log
+}
+
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	buf := record.Data
+	switch requestType(buf[0]) {
+	case appendRequestType:
+		var req api.ProduceRequest
+		if err := proto.Unmarshal(buf[1:], &req); err != nil {
+			return err
+		}
+		if err := f.appendAt([]*api.Record{req.Record}); err != nil {
+			return err
+		}
+		return req.Record.Offset
+	case appendBatchRequestType:
+		var req api.ProduceBatchRequest
+		if err := proto.Unmarshal(buf[1:], &req); err != nil {
+			return err
+		}
+		if err := f.appendAt(req.Records); err != nil {
+			return err
+		}
+		return batchResponse{first: req.Records[0].Offset, last: req.Records[len(req.Records)-1].Offset}
+	}
+	return fmt.Errorf("unknown request type %d", buf[0])
+}
+
+// errOffsetTaken fails an entry whose offsets are already in the log.
+var errOffsetTaken = errors.New("log: offset already taken")
+
+// appendAt writes records at the offsets the leader gave them. The records
+// already in the log are skipped, as raft applies the entries after the last
+// snapshot again when a node restarts, and the entry then fails: it is either
+// such a replay nobody waits for or was stamped by a stale leader.
+func (f *fsm) appendAt(records []*api.Record) error {
+	next := f.log.nextOffset()
+	var taken bool
+	for _, record := range records {
+		if record.Offset < next {
+			taken = true
+			continue
+		}
+		if err := f.log.AppendAt(record); err != nil {
+			return err
+		}
+	}
+	if taken {
+		return errOffsetTaken
+	}
+	return nil
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &snapshot{reader: f.log.Reader()}, nil
+}
+
+// Restore replaces the log with the records of a snapshot, which is a stream
+// of frames as written by log.Reader. The records keep their offsets and
+// timestamps, so gaps left by compaction stay.
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	var pos uint64
+	record, err := readFrame(r, &pos)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	f.log.Config.Sagment.InitialOffset = 0
+	if record != nil {
+		f.log.Config.Sagment.InitialOffset = record.Offset
+	}
+	if err := f.log.Reset(); err != nil {
+		return err
+	}
+	for record != nil {
+		if err := f.log.AppendAt(record); err != nil {
+			return err
+		}
+		record, err = readFrame(r, &pos)
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFrame decodes the record of the next frame at *pos, it returns io.EOF
+// at the end of r.
+func readFrame(r io.Reader, pos *uint64) (*api.Record, error) {
+	header := make([]byte, lenWidth)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, frameLen(enc.Uint64(header)))
+	copy(frame, header)
+	if _, err := io.ReadFull(r, frame[lenWidth:]); err != nil {
+		return nil, err
+	}
+	b, err := decodeFrame(frame, *pos)
+	if err != nil {
+		return nil, err
+	}
+	*pos += uint64(len(frame))
+	record := &api.Record{}
+	if err := proto.Unmarshal(b, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+type snapshot struct {
+	reader io.Reader
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := io.Copy(sink, s.reader); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
+
+var _ raft.LogStore = (*logStore)(nil)
+
+// logStore keeps the raft log in a log, the raft index of an entry is its
+// offset.
+type logStore struct {
+	*log
+}
+
+func (l *logStore) FirstIndex() (uint64, error) {
+	return l.LowestOffset()
+}
+
+func (l *logStore) LastIndex() (uint64, error) {
+	return l.HighestOffset()
+}
+
+func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	in, err := l.Read(index)
+	if err != nil {
+		return err
+	}
+	out.Data = in.Value
+	out.Index = in.Offset
+	out.Type = raft.LogType(in.Type)
+	out.Term = in.Term
+	out.AppendedAt = time.Unix(0, in.Timestamp)
+	return nil
+}
+
+func (l *logStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+func (l *logStore) StoreLogs(records []*raft.Log) error {
+	last, err := l.HighestOffset()
+	if err != nil {
+		return err
+	}
+	if records[0].Index != last+1 {
+		return fmt.Errorf("raft log: entry %d stored after %d", records[0].Index, last)
+	}
+	batch := make([]*api.Record, len(records))
+	for i, record := range records {
+		batch[i] = &api.Record{
+			Value: record.Data,
+			Term:  record.Term,
+			Type:  uint32(record.Type),
+		}
+	}
+	_, _, err = l.AppendBatch(batch)
+	return err
+}
+
+// DeleteRange removes old entries once they are in a snapshot, or the
+// conflicting tail of a follower's log. When everything goes the log starts
+// over after max, where raft continues from a restored snapshot.
+func (l *logStore) DeleteRange(min, max uint64) error {
+	first, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	last, err := l.HighestOffset()
+	if err != nil {
+		return err
+	}
+	switch {
+	case min <= first && max >= last:
+		l.Config.Sagment.InitialOffset = max + 1
+		return l.Reset()
+	case max >= last:
+		return l.TruncateFrom(min)
+	default:
+		return l.Truncate(max)
+	}
+}
+
+var _ raft.StableStore = (*stableStore)(nil)
+
+// errKeyNotFound is what raft expects from a stable store for missing keys.
+var errKeyNotFound = errors.New("not found")
+
+// stableStore keeps raft's persistent state, every write is a record keyed
+// by its key in a compacted log.
+type stableStore struct {
+	mu     sync.Mutex
+	log    *log
+	values map[string][]byte
+}
+
+func newStableStore(dir string) (*stableStore, error) {
+	var c Config
+	c.Durability.Mode = DurabilitySync
+	c.Compaction.Enabled = true
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	s := &stableStore{log: log, values: make(map[string][]byte)}
+	off, err := log.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	for ; ; off++ {
+		record, err := log.Read(off)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetCompacted:
+			continue
+		case api.ErrOffsetOutOfRange:
+			return s, nil
+		default:
+			return nil, err
+		}
+		s.values[string(record.Key)] = record.Value
+	}
+}
+
+func (s *stableStore) Set(key, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.log.Append(&api.Record{Key: key, Value: val}); err != nil {
+		return err
+	}
+	s.values[string(key)] = append([]byte(nil), val...)
+	return nil
+}
+
+func (s *stableStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.values[string(key)]
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	return val, nil
+}
+
+func (s *stableStore) SetUint64(key []byte, val uint64) error {
+	b := make([]byte, 8)
+	enc.PutUint64(b, val)
+	return s.Set(key, b)
+}
+
+func (s *stableStore) GetUint64(key []byte) (uint64, error) {
+	b, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return enc.Uint64(b), nil
+}
+
+func (s *stableStore) Close() error {
+	return s.log.Close()
+}
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+// RaftRPC is the first byte of every raft connection, so that raft can share
+// a listener with other protocols.
+const RaftRPC = 1
+
+// StreamLayer carries raft's RPCs over plain or TLS connections.
+type StreamLayer struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+}
+
+func NewStreamLayer(ln net.Listener, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+	}
+}
+
+func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write([]byte{byte(RaftRPC)}); err != nil {
+		return nil, err
+	}
+	if s.peerTLSConfig != nil {
+		conn = tls.Client(conn, s.peerTLSConfig)
+	}
+	return conn, err
+}
+
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1)
+	if _, err = conn.Read(b); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
+		return nil, fmt.Errorf("not a raft rpc")
+	}
+	if s.serverTLSConfig != nil {
+		return tls.Server(conn, s.serverTLSConfig), nil
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
@@ -0,0 +1,376 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDistributedLog(t *testing.T) {
+	nodeCount := 3
+	var logs []*DistributedLog
+	var addrs []string
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := ioutil.TempDir("", "distributed-log-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+		config.Raft.RPCAddr = fmt.Sprintf("rpc-%d", i)
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String(), config.Raft.RPCAddr))
+		}
+		logs = append(logs, l)
+		addrs = append(addrs, ln.Addr().String())
+	}
+	defer func() {
+		for _, l := range logs[1:] {
+			l.Close()
+		}
+	}()
+
+	replicated := func(nodes []*DistributedLog, offset uint64, want *api.Record) {
+		require.Eventually(t, func() bool {
+			for _, l := range nodes {
+				got, err := l.Read(offset)
+				if err != nil {
+					return false
+				}
+				// the leader's stamp is kept by every replica
+				if string(got.Value) != string(want.Value) || got.Timestamp != want.Timestamp {
+					return false
+				}
+			}
+			return true
+		}, 3*time.Second, 20*time.Millisecond)
+	}
+
+	servers, err := logs[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(servers))
+	require.True(t, servers[0].IsLeader)
+	require.False(t, servers[1].IsLeader)
+	require.False(t, servers[2].IsLeader)
+	for i, server := range servers {
+		require.Equal(t, fmt.Sprintf("rpc-%d", i), server.RpcAddr)
+	}
+	// a node only publishes the servers it was told of, a follower records
+	// them though it refuses to change the cluster
+	require.Eventually(t, func() bool {
+		servers, err := logs[1].GetServers()
+		return err == nil && len(servers) == 1 && servers[0].RpcAddr == "rpc-1"
+	}, 3*time.Second, 20*time.Millisecond)
+	require.Equal(t, raft.ErrNotLeader, logs[1].Join("0", addrs[0], "rpc-0"))
+	servers, err = logs[1].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(servers))
+	require.Equal(t, "rpc-0", servers[0].RpcAddr)
+	require.True(t, servers[0].IsLeader)
+
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}
+	for _, record := range records {
+		off, err := logs[0].Append(record)
+		require.NoError(t, err)
+		replicated(logs, off, record)
+	}
+	batch := []*api.Record{{Value: []byte("third")}, {Value: []byte("fourth")}}
+	first, last, err := logs[0].AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), first)
+	require.Equal(t, uint64(3), last)
+	replicated(logs, last, batch[1])
+
+	// followers do not accept appends
+	_, err = logs[1].Append(&api.Record{Value: []byte("refused")})
+	require.Equal(t, raft.ErrNotLeader, err)
+
+	// the acknowledged records survive the loss of the leader
+	require.NoError(t, logs[0].Close())
+	followers := logs[1:]
+	var leader *DistributedLog
+	require.Eventually(t, func() bool {
+		for _, l := range followers {
+			if l.raft.State() == raft.Leader {
+				leader = l
+				return true
+			}
+		}
+		return false
+	}, 3*time.Second, 20*time.Millisecond)
+	for off, want := range []string{"first", "second", "third", "fourth"} {
+		got, err := leader.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, string(got.Value))
+	}
+	record := &api.Record{Value: []byte("fifth")}
+	off, err := leader.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	replicated(followers, off, record)
+}
+
+func TestDistributedLogRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	open := func(ln net.Listener) *DistributedLog {
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = "0"
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = true
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+		// the entries after the snapshot are applied again once committed
+		require.NoError(t, l.raft.Barrier(3*time.Second).Error())
+		return l
+	}
+	restart := func(l *DistributedLog) *DistributedLog {
+		require.NoError(t, l.Close())
+		ln, err := net.Listen("tcp", addr)
+		require.NoError(t, err)
+		return open(ln)
+	}
+	check := func(l *DistributedLog, want []*api.Record) {
+		highest, err := l.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(want)-1), highest)
+		for _, record := range want {
+			got, err := l.Read(record.Offset)
+			require.NoError(t, err)
+			require.Equal(t, record.Value, got.Value)
+			require.Equal(t, record.Timestamp, got.Timestamp)
+		}
+	}
+
+	l := open(ln)
+	var want []*api.Record
+	for i := 0; i < 3; i++ {
+		record := &api.Record{Value: []byte(fmt.Sprint(i))}
+		_, err := l.Append(record)
+		require.NoError(t, err)
+		want = append(want, record)
+	}
+
+	// raft applies its whole log again, the records are not appended twice
+	l = restart(l)
+	check(l, want)
+	record := &api.Record{Value: []byte("3")}
+	off, err := l.Append(record)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	want = append(want, record)
+
+	// and after a snapshot it restores the log and applies what follows
+	require.NoError(t, l.raft.Snapshot().Error())
+	record = &api.Record{Value: []byte("4")}
+	_, err = l.Append(record)
+	require.NoError(t, err)
+	want = append(want, record)
+	l = restart(l)
+	defer l.Close()
+	check(l, want)
+}
+
+func TestDistributedLogRetention(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config := Config{}
+	config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = "0"
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.Bootstrap = true
+	config.Sagment.MaxStoreBytes = 128
+	config.Retention.MaxBytes = 256
+	config.Retention.CheckInterval = 10 * time.Millisecond
+	l, err := NewDistributedLog(t.TempDir(), config)
+	require.NoError(t, err)
+	defer l.Close()
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+	for i := 0; i < 20; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+
+	// retention drops the oldest records
+	require.Eventually(t, func() bool {
+		_, err := l.Read(0)
+		return err != nil
+	}, 3*time.Second, 10*time.Millisecond)
+	// but not the raft entries, which are synced as they are stored
+	require.Equal(t, DurabilitySync, l.raftLog.Config.Durability.Mode)
+	first, err := l.raftLog.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.NoError(t, l.raftLog.GetLog(1, &raft.Log{}))
+}
+
+func TestLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Sagment.InitialOffset = 1
+	c.Sagment.MaxIndexBytes = entWidth * 2
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	store := &logStore{l}
+	defer store.Close()
+
+	var entries []*raft.Log
+	for i := uint64(1); i <= 5; i++ {
+		entries = append(entries, &raft.Log{Index: i, Term: 1, Data: []byte{byte(i)}})
+	}
+	require.NoError(t, store.StoreLogs(entries))
+	got := &raft.Log{}
+	require.NoError(t, store.GetLog(3, got))
+	require.Equal(t, []byte{3}, got.Data)
+	require.Equal(t, uint64(1), got.Term)
+
+	// a follower drops the tail that conflicts with the leader
+	require.NoError(t, store.DeleteRange(4, 5))
+	last, err := store.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), last)
+	require.NoError(t, store.StoreLog(&raft.Log{Index: 4, Term: 2, Data: []byte("new")}))
+	require.NoError(t, store.GetLog(4, got))
+	require.Equal(t, uint64(2), got.Term)
+	require.Error(t, store.StoreLog(&raft.Log{Index: 6, Term: 2}))
+
+	// compacted entries go a segment at a time
+	require.NoError(t, store.DeleteRange(1, 2))
+	first, err := store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), first)
+
+	// a restored snapshot replaces the whole log
+	require.NoError(t, store.DeleteRange(3, 10))
+	require.NoError(t, store.StoreLog(&raft.Log{Index: 11, Term: 3}))
+	first, err = store.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), first)
+}
+
+func TestStableStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stable-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := newStableStore(dir)
+	require.NoError(t, err)
+
+	_, err = s.GetUint64([]byte("CurrentTerm"))
+	require.Equal(t, errKeyNotFound, err)
+	require.NoError(t, s.SetUint64([]byte("CurrentTerm"), 1))
+	require.NoError(t, s.SetUint64([]byte("CurrentTerm"), 2))
+	require.NoError(t, s.Set([]byte("LastVoteCand"), []byte("node-1")))
+	require.NoError(t, s.Close())
+
+	s, err = newStableStore(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	term, err := s.GetUint64([]byte("CurrentTerm"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), term)
+	cand, err := s.Get([]byte("LastVoteCand"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("node-1"), cand)
+}
+
+func TestFSMSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsm-snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Sagment.InitialOffset = 5
+	src, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer src.Close()
+	// a gap as compaction leaves it
+	var records []*api.Record
+	for i, value := range []string{"first", "second", "third"} {
+		record := &api.Record{Value: []byte(value), Offset: uint64(5 + i*2)}
+		require.NoError(t, src.AppendAt(record))
+		records = append(records, record)
+	}
+
+	snaps := raft.NewInmemSnapshotStore()
+	persist := func(l *log) string {
+		snap, err := (&fsm{log: l}).Snapshot()
+		require.NoError(t, err)
+		sink, err := snaps.Create(raft.SnapshotVersionMax, 3, 1, raft.Configuration{}, 0, nil)
+		require.NoError(t, err)
+		require.NoError(t, snap.Persist(sink))
+		return sink.ID()
+	}
+	id := persist(src)
+
+	dstDir, err := ioutil.TempDir("", "fsm-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dstDir)
+	dst, err := NewLog(dstDir, Config{})
+	require.NoError(t, err)
+	defer dst.Close()
+	_, err = dst.Append(&api.Record{Value: []byte("stale")})
+	require.NoError(t, err)
+
+	restore := func(id string) {
+		_, r, err := snaps.Open(id)
+		require.NoError(t, err)
+		require.NoError(t, (&fsm{log: dst}).Restore(r))
+	}
+	restore(id)
+	_, err = dst.Read(0)
+	require.Error(t, err)
+	for _, want := range records {
+		got, err := dst.Read(want.Offset)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, want.Timestamp, got.Timestamp)
+	}
+	_, err = dst.Read(6)
+	require.IsType(t, api.ErrOffsetCompacted{}, err)
+
+	// an empty snapshot leaves an empty log
+	emptyDir, err := ioutil.TempDir("", "fsm-empty-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(emptyDir)
+	empty, err := NewLog(emptyDir, Config{})
+	require.NoError(t, err)
+	defer empty.Close()
+	restore(persist(empty))
+	_, err = dst.Read(5)
+	require.Error(t, err)
+	require.Equal(t, uint64(0), dst.nextOffset())
+}
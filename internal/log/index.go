@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
 
 	"github.com/tysonmote/gommap"
 )
@@ -84,6 +85,30 @@ func (idx *index) Read(indexPos int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+// Find returns the store position of the record with the relative offset
+// off. Compacted segments have gaps, so when the entry at position off is not
+// the one asked for the entries are binary searched.
+func (idx *index) Find(off uint32) (uint64, bool) {
+	entries := idx.size / entWidth
+	if uint64(off) < entries {
+		if got, pos, err := idx.Read(int64(off)); err == nil && got == off {
+			return pos, true
+		}
+	}
+	i := sort.Search(int(entries), func(i int) bool {
+		got, _, _ := idx.Read(int64(i))
+		return got >= off
+	})
+	if uint64(i) == entries {
+		return 0, false
+	}
+	got, pos, err := idx.Read(int64(i))
+	if err != nil || got != off {
+		return 0, false
+	}
+	return pos, true
+}
+
 func (idx *index) Name() string {
 	return idx.File.Name()
 }
@@ -1,6 +1,8 @@
 package log
 
 import (
+	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
@@ -9,16 +11,30 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	api "github.com/abdelwhab-1/proglog/api/v1"
 )
 
+var (
+	ErrEmptyBatch = errors.New("log: empty batch")
+	ErrClosed     = errors.New("log: closed")
+)
+
 type log struct {
 	mu            sync.RWMutex
 	segments      []*segment
 	activeSegment *segment
 	Dir           string
 	Config        Config
+	recovered     []SegmentRecovery
+	committer     *groupCommitter
+	cleaner       *cleaner
+	compactor     *worker
+	// appended is closed and replaced whenever records are appended, Wait
+	// blocks on it.
+	appended chan struct{}
+	closed   bool
 }
 
 func NewLog(dir string, con Config) (*log, error) {
@@ -28,11 +44,60 @@ func NewLog(dir string, con Config) (*log, error) {
 	if con.Sagment.MaxStoreBytes == 0 {
 		con.Sagment.MaxStoreBytes = 1024
 	}
+	if con.Sagment.TimeIndexIntervalBytes == 0 {
+		con.Sagment.TimeIndexIntervalBytes = 4096
+	}
+	if con.Durability.Mode == DurabilityGroup && con.Durability.Interval == 0 {
+		con.Durability.Interval = 10 * time.Millisecond
+	}
+	if con.Retention.CheckInterval == 0 {
+		con.Retention.CheckInterval = time.Minute
+	}
+	if con.Compaction.Interval == 0 {
+		con.Compaction.Interval = time.Minute
+	}
 	log := &log{
-		Dir:    dir,
-		Config: con,
+		Dir:      dir,
+		Config:   con,
+		appended: make(chan struct{}),
+	}
+	if err := log.setup(); err != nil {
+		return nil, err
+	}
+	log.start()
+	return log, nil
+}
+
+// start launches the background work the configuration asks for.
+func (log *log) start() {
+	con := log.Config
+	if con.Durability.Mode == DurabilityGroup {
+		log.committer = newGroupCommitter(con.Durability.MaxRecords, con.Durability.Interval, log.syncActive)
 	}
-	return log, log.setup()
+	if log.retentionEnabled() {
+		log.startCleaner()
+	}
+	if con.Compaction.Enabled {
+		log.compactor = startWorker(con.Compaction.Interval, func(now time.Time) {
+			// a failed pass leaves the segments untouched and is retried
+			_ = log.compact(now)
+		})
+	}
+}
+
+// stop waits for the background work to finish, pending group commits are
+// synced.
+func (log *log) stop() error {
+	if log.cleaner != nil {
+		log.cleaner.Stop()
+	}
+	if log.compactor != nil {
+		log.compactor.Stop()
+	}
+	if log.committer != nil {
+		return log.committer.close()
+	}
+	return nil
 }
 
 func (log *log) setup() error {
@@ -41,12 +106,24 @@ func (log *log) setup() error {
 		return err
 	}
 	var baseOffset []uint64
+	seen := make(map[uint64]bool)
 	for _, fInfo := range fsInfo {
+		if path.Ext(fInfo.Name()) == compactedSuffix {
+			if err := os.Remove(path.Join(log.Dir, fInfo.Name())); err != nil {
+				return err
+			}
+			continue
+		}
 		offStr := strings.TrimSuffix(fInfo.Name(), path.Ext(fInfo.Name()))
 		off, err := strconv.ParseUint(offStr, 10, 0)
 		if err != nil {
 			return err
 		}
+		// every segment has a store, an index and a time index file
+		if seen[off] {
+			continue
+		}
+		seen[off] = true
 		baseOffset = append(baseOffset, off)
 	}
 	sort.Slice(baseOffset, func(i, j int) bool { return baseOffset[i] < baseOffset[j] })
@@ -54,7 +131,13 @@ func (log *log) setup() error {
 		if err := log.newSegment(baseOffset[i]); err != nil {
 			return err
 		}
-		i++
+		report, err := log.activeSegment.recover()
+		if err != nil {
+			return err
+		}
+		if report.Repaired() {
+			log.recovered = append(log.recovered, report)
+		}
 	}
 	if log.segments == nil {
 		if err := log.newSegment(log.Config.Sagment.InitialOffset); err != nil {
@@ -65,6 +148,14 @@ func (log *log) setup() error {
 	return nil
 }
 
+// Recovered returns the segments that had to be repaired when the log was
+// opened, it is empty after a clean shutdown.
+func (log *log) Recovered() []SegmentRecovery {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+	return append([]SegmentRecovery(nil), log.recovered...)
+}
+
 func (log *log) newSegment(off uint64) error {
 	seg, err := newSegment(log.Dir, off, log.Config)
 	if err != nil {
@@ -76,37 +167,274 @@ func (log *log) newSegment(off uint64) error {
 }
 
 func (log *log) Append(record *api.Record) (uint64, error) {
+	off, seq, err := log.append(record, false)
+	if err != nil {
+		return 0, err
+	}
+	if log.committer != nil {
+		return off, log.committer.wait(seq)
+	}
+	return off, nil
+}
+
+// AppendAt appends a record with the offset and timestamp it already has, so
+// that a follower's log mirrors its leader's. The offset must not be before
+// the end of the log, the ones skipped read as compacted.
+func (log *log) AppendAt(record *api.Record) error {
+	_, seq, err := log.append(record, true)
+	if err != nil {
+		return err
+	}
+	if log.committer != nil {
+		return log.committer.wait(seq)
+	}
+	return nil
+}
+
+// append writes the record, at its own offset when at is set, and applies
+// the per record part of the durability policy. The index is not synced,
+// recovery rebuilds it from the store after a crash.
+func (log *log) append(record *api.Record, at bool) (uint64, uint64, error) {
 	log.mu.Lock()
 	defer log.mu.Unlock()
-	off, err := log.activeSegment.Append(record)
+	var off uint64
+	var err error
+	if at {
+		off, err = log.activeSegment.AppendAt(record)
+	} else {
+		off, err = log.activeSegment.Append(record)
+	}
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+	seq, err := log.commit(1)
+	if err != nil {
+		return 0, 0, err
 	}
+	log.notify()
 	if log.activeSegment.isMaxedOut() {
-		err = log.newSegment(off + 1)
+		err = log.roll(off + 1)
 	}
-	return off, err
+	return off, seq, err
+}
+
+// AppendBatch appends all records or none of them and returns the offsets of
+// the first and the last one. Segments are rolled in the middle of the batch
+// when needed and the durability policy is applied once for the whole batch.
+func (log *log) AppendBatch(records []*api.Record) (uint64, uint64, error) {
+	if len(records) == 0 {
+		return 0, 0, ErrEmptyBatch
+	}
+	first, last, seq, err := log.appendBatch(records)
+	if err != nil {
+		return 0, 0, err
+	}
+	if log.committer != nil {
+		return first, last, log.committer.wait(seq)
+	}
+	return first, last, nil
+}
+
+func (log *log) appendBatch(records []*api.Record) (first, last, seq uint64, err error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	start := len(log.segments) - 1
+	mark := log.activeSegment.mark()
+	for i, record := range records {
+		last, err = log.activeSegment.Append(record)
+		if err == nil && log.activeSegment.isMaxedOut() {
+			err = log.roll(last + 1)
+		}
+		if err != nil {
+			if rerr := log.rollback(start, mark); rerr != nil {
+				return 0, 0, 0, rerr
+			}
+			return 0, 0, 0, err
+		}
+		if i == 0 {
+			first = last
+		}
+	}
+	seq, err = log.commit(uint64(len(records)))
+	if err == nil {
+		log.notify()
+	}
+	return first, last, seq, err
+}
+
+// notify wakes up everyone waiting for new records.
+func (log *log) notify() {
+	close(log.appended)
+	log.appended = make(chan struct{})
+}
+
+// Wait blocks until the record at off has been appended, ctx is done or the
+// log is closed.
+func (log *log) Wait(ctx context.Context, off uint64) error {
+	for {
+		log.mu.RLock()
+		next, appended, closed := log.activeSegment.nextOffset, log.appended, log.closed
+		log.mu.RUnlock()
+		if closed {
+			return ErrClosed
+		}
+		if off < next {
+			return nil
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// commit applies the durability policy to n records just written to the
+// active segment and returns the group commit sequence to wait for.
+func (log *log) commit(n uint64) (uint64, error) {
+	switch log.Config.Durability.Mode {
+	case DurabilitySync:
+		return 0, log.activeSegment.Store.Sync()
+	case DurabilityGroup:
+		return log.committer.add(n), nil
+	default:
+		return 0, log.activeSegment.Store.Flush()
+	}
+}
+
+// roll makes the active segment durable according to the policy and starts a
+// new one at off. The group committer only syncs the active segment, so
+// whatever is pending in this one has to reach the disk first.
+func (log *log) roll(off uint64) error {
+	var err error
+	if log.Config.Durability.Mode == DurabilityOS {
+		err = log.activeSegment.Store.Flush()
+	} else {
+		err = log.activeSegment.Store.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	return log.newSegment(off)
+}
+
+// rollback undoes a partially written batch, segments created after start are
+// removed and the segment at start is cut back to mark.
+func (log *log) rollback(start int, mark segmentMark) error {
+	for _, seg := range log.segments[start+1:] {
+		if err := seg.Remove(); err != nil {
+			return err
+		}
+	}
+	log.segments = log.segments[:start+1]
+	log.activeSegment = log.segments[start]
+	return log.activeSegment.reset(mark)
+}
+
+// syncActive fsyncs the active segment and returns the number of the last
+// record it covers, older segments were synced when they were rolled.
+func (log *log) syncActive() (uint64, error) {
+	log.mu.RLock()
+	seq := log.committer.lastWritten()
+	seg := log.activeSegment
+	log.mu.RUnlock()
+	return seq, seg.Store.Sync()
 }
 
 func (log *log) Read(off uint64) (*api.Record, error) {
 	log.mu.RLock()
 	defer log.mu.RUnlock()
 	var s *segment
-	for _, seg := range log.segments {
-		if seg.baseOffset <= off && off < seg.nextOffset {
+	var last bool
+	for i, seg := range log.segments {
+		if seg.baseOffset <= off {
 			s = seg
-			break
+			last = i == len(log.segments)-1
 		}
 	}
-	if s == nil || s.nextOffset <= off {
+	if s == nil {
+		return nil, api.ErrOffsetOutOfRange{OffSet: off}
+	}
+	if s.nextOffset <= off {
+		// compaction may have removed the tail of a closed segment, the
+		// offsets up to the next segment existed once.
+		if !last {
+			return nil, api.ErrOffsetCompacted{OffSet: off}
+		}
 		return nil, api.ErrOffsetOutOfRange{OffSet: off}
 	}
 	return s.Read(off)
 }
 
+// ReadBatch returns up to max records starting at off that take at most
+// maxBytes of the stores, or just the first one when it is larger. It reads
+// on into the following segments until either limit is reached, offsets
+// removed by compaction are skipped.
+func (log *log) ReadBatch(off uint64, max int, maxBytes uint64) ([]*api.Record, error) {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+	start := -1
+	for i, seg := range log.segments {
+		if seg.baseOffset <= off {
+			start = i
+		}
+	}
+	if start < 0 || log.activeSegment.nextOffset <= off {
+		return nil, api.ErrOffsetOutOfRange{OffSet: off}
+	}
+	var records []*api.Record
+	for _, seg := range log.segments[start:] {
+		if len(records) == max || maxBytes == 0 {
+			break
+		}
+		if off < seg.baseOffset {
+			off = seg.baseOffset
+		}
+		batch, size, err := seg.ReadBatch(off, max-len(records), maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxBytes {
+			// only the first record may go over maxBytes
+			if len(records) > 0 {
+				break
+			}
+			size = maxBytes
+		}
+		maxBytes -= size
+		records = append(records, batch...)
+	}
+	return records, nil
+}
+
+// OffsetForTime returns the first offset appended at or after t. When every
+// record is older than t it returns the offset the next record will get.
+func (log *log) OffsetForTime(t time.Time) (uint64, error) {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+	ts := t.UnixNano()
+	for _, seg := range log.segments {
+		off, ok, err := seg.offsetForTime(ts)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return off, nil
+		}
+	}
+	return log.activeSegment.nextOffset, nil
+}
+
 func (log *log) Close() error {
+	if err := log.stop(); err != nil {
+		return err
+	}
 	log.mu.Lock()
 	defer log.mu.Unlock()
+	if !log.closed {
+		log.closed = true
+		close(log.appended)
+	}
 	for _, seg := range log.segments {
 		if err := seg.Close(); err != nil {
 			return err
@@ -123,13 +451,25 @@ func (log *log) Remove() error {
 	return os.Remove(log.Dir)
 }
 
+// Reset drops every record and starts the log over at
+// Config.Sagment.InitialOffset.
 func (log *log) Reset() error {
+	if err := log.stop(); err != nil {
+		return err
+	}
 	log.mu.Lock()
 	defer log.mu.Unlock()
-	if err := log.Remove(); err != nil {
+	for _, seg := range log.segments {
+		if err := seg.Remove(); err != nil {
+			return err
+		}
+	}
+	log.segments = nil
+	if err := log.setup(); err != nil {
 		return err
 	}
-	return log.setup()
+	log.start()
+	return nil
 }
 
 func (log *log) LowestOffset() (uint64, error) {
@@ -138,6 +478,13 @@ func (log *log) LowestOffset() (uint64, error) {
 	return log.segments[0].baseOffset, nil
 }
 
+// nextOffset returns the offset the next appended record gets.
+func (log *log) nextOffset() uint64 {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+	return log.activeSegment.nextOffset
+}
+
 func (log *log) HighestOffset() (uint64, error) {
 	log.mu.Lock()
 	defer log.mu.Unlock()
@@ -148,12 +495,14 @@ func (log *log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// Truncate removes the segments that only hold offsets up to off, the active
+// segment is always kept.
 func (log *log) Truncate(off uint64) error {
 	log.mu.Lock()
 	defer log.mu.Unlock()
 	var segments []*segment
 	for _, seg := range log.segments {
-		if seg.nextOffset <= off+1 {
+		if seg != log.activeSegment && seg.nextOffset <= off+1 {
 			if err := seg.Remove(); err != nil {
 				return err
 			}
@@ -165,23 +514,67 @@ func (log *log) Truncate(off uint64) error {
 	return nil
 }
 
+// TruncateFrom removes off and every record after it, the next record is
+// appended at off.
+func (log *log) TruncateFrom(off uint64) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	i := len(log.segments) - 1
+	for i >= 0 && log.segments[i].baseOffset > off {
+		i--
+	}
+	if i < 0 {
+		return api.ErrOffsetOutOfRange{OffSet: off}
+	}
+	for _, seg := range log.segments[i+1:] {
+		if err := seg.Remove(); err != nil {
+			return err
+		}
+	}
+	log.segments = log.segments[:i+1]
+	log.activeSegment = log.segments[i]
+	return log.activeSegment.truncate(off)
+}
+
+// Reader returns the whole log as a stream of uncompressed, checksummed
+// frames whatever codec the records were stored with.
 func (log *log) Reader() io.Reader {
 	log.mu.RLock()
 	defer log.mu.RUnlock()
 	readers := make([]io.Reader, len(log.segments))
 	for i, seg := range log.segments {
-		readers[i] = &originReader{seg.Store, 0}
+		readers[i] = &originReader{store: seg.Store}
 	}
 	return io.MultiReader(readers...)
 }
 
+// SegmentStats returns the size and compression ratio of every segment.
+func (log *log) SegmentStats() []SegmentStats {
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+	stats := make([]SegmentStats, len(log.segments))
+	for i, seg := range log.segments {
+		stats[i] = seg.stats()
+	}
+	return stats
+}
+
 type originReader struct {
 	*store
-	off int64
+	off   uint64
+	frame []byte
 }
 
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
-	o.off += int64(n)
-	return n, err
+	if len(o.frame) == 0 {
+		record, next, err := o.ReadFrame(o.off)
+		if err != nil {
+			return 0, err
+		}
+		o.frame = encodeFrame(record)
+		o.off = next
+	}
+	n := copy(p, o.frame)
+	o.frame = o.frame[n:]
+	return n, nil
 }
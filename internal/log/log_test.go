@@ -1,9 +1,15 @@
 package log
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	api "github.com/abdelwhab-1/proglog/api/v1"
 	"github.com/stretchr/testify/require"
@@ -18,6 +24,7 @@ func TestLog(t *testing.T) {
 		"init with existing segments": testInitExisting,
 		"reader":                      testReader,
 		"truncate":                    testTruncate,
+		"recover after crash":         testRecoverAfterCrash,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "log_test")
@@ -90,7 +97,7 @@ func testReader(t *testing.T, log *log) {
 	val, err := ioutil.ReadAll(reader)
 	require.NoError(t, err)
 	red := &api.Record{}
-	err = proto.Unmarshal(val[lenWidth:], red)
+	err = proto.Unmarshal(val[frameWidth:], red)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, red.Value)
 }
@@ -108,3 +115,514 @@ func testTruncate(t *testing.T, log *log) {
 	require.Error(t, err)
 	require.Nil(t, red)
 }
+
+func testRecoverAfterCrash(t *testing.T, log *log) {
+	append := &api.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	// simulate a crash: the data reached the files but nothing was closed,
+	// so the index files are still padded to MaxIndexBytes.
+	for _, seg := range log.segments {
+		require.NoError(t, seg.Store.buff.Flush())
+	}
+	last := log.activeSegment.baseOffset
+	f, err := os.OpenFile(path.Join(log.Dir, fmt.Sprintf("%d.store", last)), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	torn := make([]byte, frameWidth)
+	enc.PutUint64(torn, encodeFrameLen(frameVersionCRC, 100))
+	_, err = f.Write(torn[:lenWidth+2])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	nLog, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	off, err := nLog.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	var truncated uint64
+	for _, report := range nLog.Recovered() {
+		require.True(t, report.IndexRebuilt)
+		truncated += report.TruncatedBytes
+	}
+	require.Equal(t, lenWidth+2, truncated)
+
+	for i := uint64(0); i <= off; i++ {
+		red, err := nLog.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, append.Value, red.Value)
+	}
+	off, err = nLog.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func TestLogDurability(t *testing.T) {
+	for scenario, mode := range map[string]Durability{
+		"os":    DurabilityOS,
+		"sync":  DurabilitySync,
+		"group": DurabilityGroup,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "log_durability_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Sagment.MaxStoreBytes = 64
+			c.Durability.Mode = mode
+			c.Durability.MaxRecords = 4
+			c.Durability.Interval = 5 * time.Millisecond
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := log.Append(&api.Record{Value: []byte("hello world")})
+					require.NoError(t, err)
+				}()
+			}
+			wg.Wait()
+
+			// every acknowledged record has left the write buffer
+			for _, seg := range log.segments {
+				info, err := seg.Store.File.Stat()
+				require.NoError(t, err)
+				require.Equal(t, seg.Store.size, uint64(info.Size()))
+			}
+			off, err := log.HighestOffset()
+			require.NoError(t, err)
+			require.Equal(t, uint64(9), off)
+			require.NoError(t, log.Close())
+		})
+	}
+}
+
+func TestLogAppendBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_batch_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Sagment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	_, _, err = log.AppendBatch(nil)
+	require.Equal(t, ErrEmptyBatch, err)
+
+	var records []*api.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+	first, last, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+	require.Equal(t, uint64(4), last)
+	// the batch did not fit in a single segment
+	require.True(t, len(log.segments) > 1)
+	for i, want := range records {
+		red, err := log.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, want.Value, red.Value)
+	}
+
+	first, last, err = log.AppendBatch(records[:1])
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), first)
+	require.Equal(t, uint64(5), last)
+}
+
+func TestLogAppendBatchRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_batch_rollback_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Sagment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("kept")})
+	require.NoError(t, err)
+
+	// the index of the next segment only has room for a single entry,
+	// so the batch fails after it has already rolled once.
+	log.Config.Sagment.MaxIndexBytes = entWidth + 1
+	var records []*api.Record
+	for i := 0; i < 6; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf("a long record value %d", i))})
+	}
+	_, _, err = log.AppendBatch(records)
+	require.Error(t, err)
+	require.Equal(t, 1, len(log.segments))
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	log.Config.Sagment.MaxIndexBytes = 1024
+	off, err = log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	red, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("next"), red.Value)
+}
+
+func TestLogRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_retention_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Sagment.MaxStoreBytes = 32
+	c.Retention.MaxBytes = 64
+	c.Retention.MaxAge = time.Hour
+	c.Retention.MinSegments = 2
+	c.Retention.CheckInterval = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 8; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.clean(time.Now()))
+	var total uint64
+	for _, seg := range log.segments {
+		total += seg.Store.size
+	}
+	require.True(t, total <= c.Retention.MaxBytes)
+	stats := log.RetentionStats()
+	require.NotZero(t, stats.SegmentsRemoved)
+	require.NotZero(t, stats.BytesReclaimed)
+
+	// everything is too old now, but MinSegments are kept
+	require.NoError(t, log.clean(time.Now().Add(2*time.Hour)))
+	require.Equal(t, 2, len(log.segments))
+	require.Equal(t, log.activeSegment, log.segments[1])
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	_, err = log.Read(lowest - 1)
+	require.Error(t, err)
+}
+
+func TestLogRetentionCleaner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_retention_cleaner_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Sagment.MaxStoreBytes = 32
+	c.Retention.MaxBytes = 1
+	c.Retention.CheckInterval = time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+		return len(log.segments) == 1
+	}, time.Second, time.Millisecond)
+	require.NoError(t, log.Close())
+}
+
+func TestLogCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_compaction_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Sagment.MaxStoreBytes = 32
+	c.Compaction.Enabled = true
+	c.Compaction.TombstoneGrace = time.Hour
+	c.Compaction.Interval = time.Hour
+	cLog, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	records := []*api.Record{
+		{Key: []byte("k1"), Value: []byte("a")},
+		{Key: []byte("k2"), Value: []byte("a")},
+		{Key: []byte("k1"), Value: []byte("b")},
+		{Value: []byte("no key")},
+		{Key: []byte("k2")},
+		{Key: []byte("k3"), Value: []byte("a")},
+		{Key: []byte("k1"), Value: []byte("c")},
+	}
+	for _, record := range records {
+		_, err := cLog.Append(record)
+		require.NoError(t, err)
+	}
+	require.True(t, len(cLog.segments) > 2)
+
+	requireCompacted := func(l *log, off uint64) {
+		t.Helper()
+		_, err := l.Read(off)
+		require.Equal(t, api.ErrOffsetCompacted{OffSet: off}, err)
+	}
+	requireKept := func(l *log, off uint64) {
+		t.Helper()
+		red, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, records[off].Value, red.Value)
+		require.Equal(t, records[off].Key, red.Key)
+		require.Equal(t, off, red.Offset)
+	}
+
+	require.NoError(t, cLog.compact(time.Now()))
+	requireCompacted(cLog, 0)
+	requireCompacted(cLog, 1)
+	requireCompacted(cLog, 2)
+	requireKept(cLog, 3)
+	requireKept(cLog, 4)
+	requireKept(cLog, 5)
+	requireKept(cLog, 6)
+
+	// the tombstone outlived its grace period
+	require.NoError(t, cLog.compact(time.Now().Add(2*time.Hour)))
+	requireCompacted(cLog, 4)
+	requireKept(cLog, 3)
+
+	require.NoError(t, cLog.Close())
+	nLog, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer nLog.Close()
+	requireCompacted(nLog, 0)
+	requireCompacted(nLog, 4)
+	requireKept(nLog, 3)
+	requireKept(nLog, 6)
+	off, err := nLog.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+	_, err = nLog.Read(7)
+	require.Equal(t, api.ErrOffsetOutOfRange{OffSet: 7}, err)
+}
+
+func TestLogCompactionSwap(t *testing.T) {
+	c := Config{}
+	c.Sagment.MaxStoreBytes = 32
+	c.Compaction.Interval = time.Hour
+	cLog, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer cLog.Close()
+	for i := 0; i < 4; i++ {
+		_, err := cLog.Append(&api.Record{Key: []byte("k"), Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	require.True(t, len(cLog.segments) > 2)
+
+	// the segments are rewritten while readers go on
+	cLog.mu.RLock()
+	compactions, err := cLog.rewriteSegments(time.Now())
+	_, readErr := cLog.Read(0)
+	cLog.mu.RUnlock()
+	require.NoError(t, err)
+	require.NoError(t, readErr)
+	require.NotEmpty(t, compactions)
+
+	// a segment cut in the meantime is not swapped back in
+	require.NoError(t, cLog.TruncateFrom(1))
+	cLog.mu.Lock()
+	require.NoError(t, cLog.swapSegments(compactions))
+	cLog.mu.Unlock()
+	red, err := cLog.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("0"), red.Value)
+	leftovers, err := filepath.Glob(filepath.Join(cLog.Dir, "*"+compactedSuffix))
+	require.NoError(t, err)
+	require.Empty(t, leftovers)
+}
+
+func TestLogOffsetForTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_time_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Sagment.MaxStoreBytes = 128
+	c.Sagment.TimeIndexIntervalBytes = 64
+	tLog, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	start := time.Now()
+	var stamps []time.Time
+	for i := 0; i < 12; i++ {
+		off, err := tLog.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		red, err := tLog.Read(off)
+		require.NoError(t, err)
+		stamps = append(stamps, time.Unix(0, red.Timestamp))
+		time.Sleep(time.Millisecond)
+	}
+	require.True(t, len(tLog.segments) > 1)
+
+	check := func(l *log) {
+		t.Helper()
+		off, err := l.OffsetForTime(start)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+		for i, ts := range stamps {
+			off, err := l.OffsetForTime(ts)
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), off)
+			off, err = l.OffsetForTime(ts.Add(-time.Nanosecond))
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), off)
+		}
+		off, err = l.OffsetForTime(stamps[len(stamps)-1].Add(time.Nanosecond))
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(stamps)), off)
+	}
+	check(tLog)
+
+	require.NoError(t, tLog.Close())
+	nLog, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer nLog.Close()
+	require.Empty(t, nLog.Recovered())
+	check(nLog)
+}
+
+func TestLogCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_compression_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Sagment.Codec = CodecZstd
+	cLog, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	verbose := []byte(`{"level":"info","service":"billing","msg":"invoice created","level":"info","service":"billing"}`)
+	for i := 0; i < 3; i++ {
+		_, err := cLog.Append(&api.Record{Value: verbose})
+		require.NoError(t, err)
+	}
+	for i := uint64(0); i < 3; i++ {
+		red, err := cLog.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, verbose, red.Value)
+	}
+	stats := cLog.SegmentStats()
+	require.Equal(t, 1, len(stats))
+	require.True(t, stats[0].CompressionRatio > 1)
+
+	val, err := ioutil.ReadAll(cLog.Reader())
+	require.NoError(t, err)
+	red := &api.Record{}
+	_, size := decodeFrameLen(enc.Uint64(val[:lenWidth]))
+	require.NoError(t, proto.Unmarshal(val[frameWidth:frameWidth+size], red))
+	require.Equal(t, verbose, red.Value)
+
+	// the stats survive a restart
+	require.NoError(t, cLog.Close())
+	nLog, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer nLog.Close()
+	require.Equal(t, stats, nLog.SegmentStats())
+}
+
+func TestLogWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_wait_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, log.Wait(ctx, 0))
+
+	done := make(chan error)
+	go func() {
+		done <- log.Wait(context.Background(), 1)
+	}()
+	_, err = log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	select {
+	case <-done:
+		t.Fatal("woke up before the offset was appended")
+	case <-time.After(10 * time.Millisecond):
+	}
+	_, _, err = log.AppendBatch([]*api.Record{{Value: []byte("second")}, {Value: []byte("third")}})
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+	require.NoError(t, log.Wait(context.Background(), 2))
+
+	go func() {
+		done <- log.Wait(context.Background(), 3)
+	}()
+	require.NoError(t, log.Close())
+	require.Equal(t, ErrClosed, <-done)
+}
+
+func TestLogReadBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_read_batch_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Sagment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 8; i++ {
+		_, err := log.Append(&api.Record{Value: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, len(log.segments))
+
+	// batches run on into the following segments
+	records, err := log.ReadBatch(1, 5, 1<<20)
+	require.NoError(t, err)
+	require.Equal(t, 5, len(records))
+	for i, record := range records {
+		require.Equal(t, uint64(i+1), record.Offset)
+		require.Equal(t, []byte{byte(i + 1)}, record.Value)
+	}
+
+	records, err = log.ReadBatch(6, 10, 1<<20)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+
+	// the records in the second segment all take the same space
+	frame := log.segments[1].Store.size / 3
+	records, err = log.ReadBatch(3, 10, 2*frame)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(records))
+	records, err = log.ReadBatch(0, 10, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(records))
+
+	_, err = log.ReadBatch(8, 10, 1<<20)
+	require.Error(t, err)
+}
+
+func TestLogAppendAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log_append_at_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	stamp := time.Now().Add(-time.Hour).UnixNano()
+	require.NoError(t, log.AppendAt(&api.Record{Value: []byte("first"), Offset: 0, Timestamp: stamp}))
+	// the leader's log had the offsets in between compacted
+	require.NoError(t, log.AppendAt(&api.Record{Value: []byte("fourth"), Offset: 3}))
+	require.Error(t, log.AppendAt(&api.Record{Value: []byte("stale"), Offset: 2}))
+
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, stamp, record.Timestamp)
+	_, err = log.Read(1)
+	require.IsType(t, api.ErrOffsetCompacted{}, err)
+	record, err = log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("fourth"), record.Value)
+
+	off, err := log.Append(&api.Record{Value: []byte("fifth")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+}
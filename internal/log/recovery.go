@@ -0,0 +1,163 @@
+package log
+
+import (
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// SegmentRecovery describes what the recovery pass had to repair in a
+// segment after an unclean shutdown.
+type SegmentRecovery struct {
+	BaseOffset uint64
+	// Records is the number of intact records kept in the segment.
+	Records uint64
+	// TruncatedBytes is the number of bytes cut from the end of the store,
+	// anything past the first invalid frame is lost.
+	TruncatedBytes uint64
+	// Corruption is the error that stopped the scan, nil when the tail of
+	// the store was simply empty.
+	Corruption       error
+	IndexRebuilt     bool
+	TimeIndexRebuilt bool
+}
+
+// Repaired reports whether the segment needed any change at all.
+func (r SegmentRecovery) Repaired() bool {
+	return r.TruncatedBytes > 0 || r.IndexRebuilt || r.TimeIndexRebuilt
+}
+
+type indexEntry struct {
+	off uint32
+	pos uint64
+}
+
+type timeEntry struct {
+	ts  int64
+	off uint32
+}
+
+// recover validates every frame of the store, cuts off a partially written
+// or corrupt tail and rebuilds the index when it disagrees with the store.
+func (seg *segment) recover() (SegmentRecovery, error) {
+	report := SegmentRecovery{BaseOffset: seg.baseOffset}
+	store := seg.Store
+	store.mu.Lock()
+	if err := store.buff.Flush(); err != nil {
+		store.mu.Unlock()
+		return report, err
+	}
+	var entries []indexEntry
+	var timeEntries []timeEntry
+	times := timeIndexer{interval: seg.conf.Sagment.TimeIndexIntervalBytes}
+	var pos, rawSize uint64
+	for pos < store.size {
+		b, width, err := store.read(pos)
+		if err != nil {
+			if _, ok := err.(api.ErrCorruptRecord); !ok {
+				store.mu.Unlock()
+				return report, err
+			}
+			report.Corruption = err
+			break
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(b, record); err != nil || record.Offset < seg.baseOffset {
+			report.Corruption = api.ErrCorruptRecord{Position: pos, Reason: "undecodable record"}
+			break
+		}
+		rel := uint32(record.Offset - seg.baseOffset)
+		entries = append(entries, indexEntry{off: rel, pos: pos})
+		if times.observe(record.Timestamp, pos) {
+			timeEntries = append(timeEntries, timeEntry{ts: record.Timestamp, off: rel})
+		}
+		pos += width
+		rawSize += frameWidth + uint64(len(b))
+	}
+	size := store.size
+	store.mu.Unlock()
+	if corrupt, ok := report.Corruption.(api.ErrCorruptRecord); ok {
+		corrupt.BaseOffset = seg.baseOffset
+		report.Corruption = corrupt
+	}
+
+	if pos < size {
+		if err := store.Truncate(pos); err != nil {
+			return report, err
+		}
+		report.TruncatedBytes = size - pos
+	}
+	report.Records = uint64(len(entries))
+	store.rawSize = rawSize
+
+	if !seg.Index.matches(entries) {
+		if err := seg.Index.rebuild(entries); err != nil {
+			return report, err
+		}
+		report.IndexRebuilt = true
+	}
+	if !seg.TimeIndex.matches(timeEntries) {
+		if err := seg.TimeIndex.rebuild(timeEntries); err != nil {
+			return report, err
+		}
+		report.TimeIndexRebuilt = true
+	}
+	seg.times = times
+
+	seg.nextOffset = seg.baseOffset
+	if len(entries) > 0 {
+		seg.nextOffset = seg.baseOffset + uint64(entries[len(entries)-1].off) + 1
+	}
+	return report, nil
+}
+
+func (idx *index) matches(entries []indexEntry) bool {
+	if idx.size != uint64(len(entries))*entWidth {
+		return false
+	}
+	for i, want := range entries {
+		off, pos, err := idx.Read(int64(i))
+		if err != nil || off != want.off || pos != want.pos {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *index) rebuild(entries []indexEntry) error {
+	idx.size = 0
+	for i := range idx.mmap {
+		idx.mmap[i] = 0
+	}
+	for _, e := range entries {
+		if err := idx.Write(e.pos, e.off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (idx *timeIndex) matches(entries []timeEntry) bool {
+	if idx.size != uint64(len(entries))*timeEntWidth {
+		return false
+	}
+	for i, want := range entries {
+		ts, off, err := idx.Read(int64(i))
+		if err != nil || ts != want.ts || off != want.off {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *timeIndex) rebuild(entries []timeEntry) error {
+	idx.size = 0
+	for i := range idx.mmap {
+		idx.mmap[i] = 0
+	}
+	for _, e := range entries {
+		if err := idx.Write(e.ts, e.off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package log
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RetentionStats counts what the retention cleaner has removed since the log
+// was opened.
+type RetentionStats struct {
+	SegmentsRemoved uint64
+	BytesReclaimed  uint64
+}
+
+type cleaner struct {
+	*worker
+	segmentsRemoved uint64
+	bytesReclaimed  uint64
+}
+
+func (log *log) retentionEnabled() bool {
+	return log.Config.Retention.MaxBytes > 0 || log.Config.Retention.MaxAge > 0
+}
+
+// startCleaner runs the retention policy every CheckInterval until Close.
+func (log *log) startCleaner() {
+	log.cleaner = &cleaner{}
+	log.cleaner.worker = startWorker(log.Config.Retention.CheckInterval, func(now time.Time) {
+		// a failed removal is retried on the next tick
+		_ = log.clean(now)
+	})
+}
+
+// clean removes the oldest segments for as long as they break the retention
+// policy. The active segment is never removed.
+func (log *log) clean(now time.Time) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	policy := log.Config.Retention
+	var total uint64
+	for _, seg := range log.segments {
+		total += seg.Store.size
+	}
+	for len(log.segments) > 1 && len(log.segments) > policy.MinSegments {
+		oldest := log.segments[0]
+		expired := false
+		if policy.MaxAge > 0 {
+			info, err := oldest.Store.File.Stat()
+			if err != nil {
+				return err
+			}
+			expired = now.Sub(info.ModTime()) > policy.MaxAge
+		}
+		if !expired && (policy.MaxBytes == 0 || total <= policy.MaxBytes) {
+			return nil
+		}
+		reclaimed := oldest.Store.size + oldest.Index.size
+		if err := oldest.Remove(); err != nil {
+			return err
+		}
+		log.segments = log.segments[1:]
+		total -= oldest.Store.size
+		atomic.AddUint64(&log.cleaner.segmentsRemoved, 1)
+		atomic.AddUint64(&log.cleaner.bytesReclaimed, reclaimed)
+	}
+	return nil
+}
+
+// RetentionStats reports how much the retention cleaner has removed.
+func (log *log) RetentionStats() RetentionStats {
+	if log.cleaner == nil {
+		return RetentionStats{}
+	}
+	return RetentionStats{
+		SegmentsRemoved: atomic.LoadUint64(&log.cleaner.segmentsRemoved),
+		BytesReclaimed:  atomic.LoadUint64(&log.cleaner.bytesReclaimed),
+	}
+}
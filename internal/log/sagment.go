@@ -2,8 +2,10 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"time"
 
 	api "github.com/abdelwhab-1/proglog/api/v1"
 	"google.golang.org/protobuf/proto"
@@ -12,14 +14,19 @@ import (
 type segment struct {
 	Index                  *index
 	Store                  *store
+	TimeIndex              *timeIndex
 	baseOffset, nextOffset uint64
 	conf                   Config
+	// times is rebuilt from the records by recover when an existing
+	// segment is opened.
+	times timeIndexer
 }
 
 func newSegment(dir string, baseOffset uint64, conf Config) (*segment, error) {
 	segment := &segment{
 		baseOffset: baseOffset,
 		conf:       conf,
+		times:      timeIndexer{interval: conf.Sagment.TimeIndexIntervalBytes},
 	}
 
 	storeFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
@@ -31,6 +38,7 @@ func newSegment(dir string, baseOffset uint64, conf Config) (*segment, error) {
 	if err != nil {
 		return nil, err
 	}
+	store.codec = conf.Sagment.Codec
 	segment.Store = store
 	idxFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
 		os.O_RDWR|os.O_CREATE, 0644)
@@ -44,6 +52,16 @@ func newSegment(dir string, baseOffset uint64, conf Config) (*segment, error) {
 	}
 
 	segment.Index = idx
+	timeIdxFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")),
+		os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	timeIdx, err := newTimeIndex(timeIdxFile, segment.conf)
+	if err != nil {
+		return nil, err
+	}
+	segment.TimeIndex = timeIdx
 
 	if off, _, err := segment.Index.Read(-1); err != nil {
 		segment.nextOffset = baseOffset
@@ -54,8 +72,25 @@ func newSegment(dir string, baseOffset uint64, conf Config) (*segment, error) {
 }
 
 func (seg *segment) Append(record *api.Record) (uint64, error) {
-	curr := seg.nextOffset
-	record.Offset = curr
+	record.Offset = seg.nextOffset
+	record.Timestamp = time.Now().UnixNano()
+	return seg.write(record)
+}
+
+// AppendAt writes the record at its own offset, which may leave a gap after
+// the previous one, and keeps its timestamp when it has one.
+func (seg *segment) AppendAt(record *api.Record) (uint64, error) {
+	if record.Offset < seg.nextOffset {
+		return 0, fmt.Errorf("log: offset %d is before the end of the segment at %d", record.Offset, seg.nextOffset)
+	}
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
+	return seg.write(record)
+}
+
+func (seg *segment) write(record *api.Record) (uint64, error) {
+	curr := record.Offset
 	b, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
@@ -70,19 +105,31 @@ func (seg *segment) Append(record *api.Record) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
+	if seg.times.observe(record.Timestamp, pos) {
+		if err = seg.TimeIndex.Write(record.Timestamp, uint32(curr-seg.baseOffset)); err != nil {
+			return 0, err
+		}
+	}
 
-	seg.nextOffset++
+	seg.nextOffset = curr + 1
 	return curr, nil
 }
 
 func (seg *segment) Read(offSet uint64) (*api.Record, error) {
-	_, pos, err := seg.Index.Read(int64(offSet - seg.baseOffset))
-	if err != nil {
-		return nil, err
+	pos, ok := seg.Index.Find(uint32(offSet - seg.baseOffset))
+	if !ok {
+		if offSet < seg.nextOffset {
+			return nil, api.ErrOffsetCompacted{OffSet: offSet}
+		}
+		return nil, io.EOF
 	}
 
 	b, err := seg.Store.Read(pos)
 	if err != nil {
+		if corrupt, ok := err.(api.ErrCorruptRecord); ok {
+			corrupt.BaseOffset = seg.baseOffset
+			return nil, corrupt
+		}
 		return nil, err
 	}
 	record := &api.Record{Value: b}
@@ -90,6 +137,133 @@ func (seg *segment) Read(offSet uint64) (*api.Record, error) {
 	return record, err
 }
 
+// ReadBatch reads up to max records from offSet on, or from the first one after
+// it that compaction left, in a single pass over the store. It also returns
+// the number of store bytes they took.
+func (seg *segment) ReadBatch(offSet uint64, max int, maxBytes uint64) ([]*api.Record, uint64, error) {
+	var pos uint64
+	found := false
+	for ; offSet < seg.nextOffset && !found; offSet++ {
+		pos, found = seg.Index.Find(uint32(offSet - seg.baseOffset))
+	}
+	if !found {
+		return nil, 0, nil
+	}
+	frames, next, err := seg.Store.ReadFrames(pos, maxBytes, max)
+	if err != nil {
+		if corrupt, ok := err.(api.ErrCorruptRecord); ok {
+			corrupt.BaseOffset = seg.baseOffset
+			return nil, 0, corrupt
+		}
+		return nil, 0, err
+	}
+	records := make([]*api.Record, len(frames))
+	for i, b := range frames {
+		records[i] = &api.Record{}
+		if err := proto.Unmarshal(b, records[i]); err != nil {
+			return nil, 0, err
+		}
+	}
+	return records, next - pos, nil
+}
+
+// segmentMark remembers the end of a segment so that a failed batch can be
+// rolled back to it.
+type segmentMark struct {
+	storeSize, rawSize, indexSize, timeIndexSize, nextOffset uint64
+	times                                                    timeIndexer
+}
+
+func (seg *segment) mark() segmentMark {
+	return segmentMark{
+		storeSize:     seg.Store.size,
+		rawSize:       seg.Store.rawSize,
+		indexSize:     seg.Index.size,
+		timeIndexSize: seg.TimeIndex.size,
+		nextOffset:    seg.nextOffset,
+		times:         seg.times,
+	}
+}
+
+func (seg *segment) reset(mark segmentMark) error {
+	if err := seg.Store.Truncate(mark.storeSize); err != nil {
+		return err
+	}
+	seg.Store.rawSize = mark.rawSize
+	seg.Index.size = mark.indexSize
+	seg.TimeIndex.size = mark.timeIndexSize
+	seg.nextOffset = mark.nextOffset
+	seg.times = mark.times
+	return nil
+}
+
+// truncate cuts the segment back to the records before offSet, the indexes
+// are rebuilt from what is left in the store.
+func (seg *segment) truncate(offSet uint64) error {
+	var pos uint64
+	found := false
+	for off := offSet; off < seg.nextOffset && !found; off++ {
+		pos, found = seg.Index.Find(uint32(off - seg.baseOffset))
+	}
+	if !found {
+		return nil
+	}
+	if err := seg.Store.Truncate(pos); err != nil {
+		return err
+	}
+	_, err := seg.recover()
+	return err
+}
+
+// offsetForTime returns the first offset in the segment appended at or after
+// ts. The time index gives the point to start from and the records after it
+// are read until one is recent enough.
+func (seg *segment) offsetForTime(ts int64) (uint64, bool, error) {
+	if seg.times.maxTs < ts {
+		return 0, false, nil
+	}
+	start := seg.baseOffset
+	if rel, ok := seg.TimeIndex.Lookup(ts); ok {
+		start += uint64(rel)
+	}
+	for off := start; off < seg.nextOffset; off++ {
+		record, err := seg.Read(off)
+		if err != nil {
+			if _, ok := err.(api.ErrOffsetCompacted); ok {
+				continue
+			}
+			return 0, false, err
+		}
+		if record.Timestamp >= ts {
+			return off, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// SegmentStats describes the size of a segment on disk.
+type SegmentStats struct {
+	BaseOffset, NextOffset uint64
+	StoreBytes             uint64
+	// RawBytes is what the store would take without compression.
+	RawBytes         uint64
+	CompressionRatio float64
+}
+
+func (seg *segment) stats() SegmentStats {
+	stats := SegmentStats{
+		BaseOffset:       seg.baseOffset,
+		NextOffset:       seg.nextOffset,
+		StoreBytes:       seg.Store.size,
+		RawBytes:         seg.Store.rawSize,
+		CompressionRatio: 1,
+	}
+	if stats.StoreBytes > 0 {
+		stats.CompressionRatio = float64(stats.RawBytes) / float64(stats.StoreBytes)
+	}
+	return stats
+}
+
 func (seg *segment) isMaxedOut() bool {
 	return seg.Store.size >= seg.conf.Sagment.MaxStoreBytes || seg.Index.size >= seg.conf.Sagment.MaxIndexBytes
 }
@@ -101,6 +275,9 @@ func (seg *segment) Close() error {
 	if err := seg.Index.Close(); err != nil {
 		return err
 	}
+	if err := seg.TimeIndex.Close(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -115,6 +292,9 @@ func (seg *segment) Remove() error {
 	if err := os.Remove(seg.Store.File.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(seg.TimeIndex.Name()); err != nil {
+		return err
+	}
 	return nil
 }
 
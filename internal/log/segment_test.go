@@ -46,3 +46,28 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, seg.isMaxedOut())
 }
+
+func TestSegmentCorruption(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment_corruption_test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Sagment.MaxStoreBytes = 1024
+	c.Sagment.MaxIndexBytes = 1024
+	seg, err := newSegment(dir, uint64(16), c)
+	require.NoError(t, err)
+	off, err := seg.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = seg.Read(off)
+	require.NoError(t, err)
+
+	f, err := os.OpenFile(seg.Store.File.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(frameWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = seg.Read(off)
+	corrupt, ok := err.(api.ErrCorruptRecord)
+	require.True(t, ok)
+	require.Equal(t, uint64(16), corrupt.BaseOffset)
+	require.Equal(t, uint64(0), corrupt.Position)
+}
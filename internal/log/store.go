@@ -3,16 +3,36 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
 )
 
 var (
-	enc = binary.BigEndian
+	enc      = binary.BigEndian
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
 const (
-	lenWidth uint64 = 8
+	lenWidth   uint64 = 8
+	crcWidth   uint64 = 4
+	frameWidth        = lenWidth + crcWidth
+
+	// the top byte of the length word holds the frame version, files
+	// written before checksums were added always have it set to zero.
+	frameVersionLegacy byte   = 0
+	frameVersionCRC    byte   = 1
+	frameVersionShift         = 56
+	frameLenMask       uint64 = 1<<frameVersionShift - 1
+
+	// compressed frames keep the codec in the byte below the version, the
+	// checksum covers the compressed payload.
+	frameVersionCompressed byte   = 2
+	frameCodecShift               = 48
+	frameCompressedLenMask uint64 = 1<<frameCodecShift - 1
 )
 
 type store struct {
@@ -20,6 +40,10 @@ type store struct {
 	mu   sync.Mutex
 	buff *bufio.Writer
 	size uint64
+	// codec compresses newly appended records, rawSize is what the frames
+	// would take uncompressed.
+	codec   Codec
+	rawSize uint64
 }
 
 func NewStore(file *os.File) (*store, error) {
@@ -29,9 +53,10 @@ func NewStore(file *os.File) (*store, error) {
 	}
 	size := stat.Size()
 	store := store{
-		File: file,
-		size: uint64(size),
-		buff: bufio.NewWriter(file),
+		File:    file,
+		size:    uint64(size),
+		rawSize: uint64(size),
+		buff:    bufio.NewWriter(file),
 	}
 	return &store, err
 }
@@ -41,16 +66,29 @@ func (store *store) Append(b []byte) (uint64, uint64, error) {
 	defer store.mu.Unlock()
 	position := store.size
 
-	if err := binary.Write(store.buff, enc, uint64(len(b))); err != nil {
-		return 0, 0, err
+	frame := encodeFrame(b)
+	if store.codec != CodecNone {
+		comp, err := store.codec.compressor()
+		if err != nil {
+			return 0, 0, err
+		}
+		compressed, err := comp.Compress(b)
+		if err != nil {
+			return 0, 0, err
+		}
+		// records that do not shrink are stored as they are
+		if len(compressed) < len(b) {
+			frame = encodeCompressedFrame(store.codec, compressed)
+		}
 	}
-	n, err := store.buff.Write(b)
-	writenBytesNum := uint64(n) + lenWidth
+	n, err := store.buff.Write(frame)
 	if err != nil {
-		return 0, 0, nil
+		return 0, 0, err
 	}
+	writenBytesNum := uint64(n)
 
 	store.size += writenBytesNum
+	store.rawSize += frameWidth + uint64(len(b))
 	return writenBytesNum, position, nil
 }
 
@@ -61,21 +99,107 @@ func (store *store) Read(position uint64) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	start_pos := make([]byte, lenWidth)
+	record, _, err := store.read(position)
+	return record, err
+}
 
-	_, err = store.File.ReadAt(start_pos, int64(position))
-	if err != nil {
-		return nil, err
+// read decodes the frame at position and returns its payload together with
+// the number of bytes the whole frame takes in the file.
+func (store *store) read(position uint64) ([]byte, uint64, error) {
+	if position+lenWidth > store.size {
+		return nil, 0, api.ErrCorruptRecord{Position: position, Reason: "truncated frame header"}
 	}
+	header := make([]byte, lenWidth)
+	if _, err := store.File.ReadAt(header, int64(position)); err != nil {
+		return nil, 0, err
+	}
+	width := frameLen(enc.Uint64(header))
+	if position+width > store.size {
+		return nil, 0, api.ErrCorruptRecord{Position: position, Reason: "truncated record"}
+	}
+	frame := make([]byte, width)
+	if _, err := store.File.ReadAt(frame, int64(position)); err != nil {
+		return nil, 0, err
+	}
+	record, err := decodeFrame(frame, position)
+	return record, width, err
+}
 
-	record := make([]byte, enc.Uint64(start_pos))
-
-	_, err = store.File.ReadAt(record, int64(position+lenWidth))
+// ReadFrames decodes up to max frames from position on with a single read of
+// at most maxBytes from the file, and returns their payloads and the position
+// after the last one. The first frame is returned even when it is larger than
+// maxBytes.
+func (store *store) ReadFrames(position, maxBytes uint64, max int) ([][]byte, uint64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.buff.Flush(); err != nil {
+		return nil, 0, err
+	}
+	if position >= store.size {
+		return nil, position, nil
+	}
+	if maxBytes > store.size-position {
+		maxBytes = store.size - position
+	}
+	chunk := make([]byte, maxBytes)
+	if _, err := store.File.ReadAt(chunk, int64(position)); err != nil {
+		return nil, 0, err
+	}
+	var records [][]byte
+	for len(records) < max {
+		if uint64(len(chunk)) < lenWidth || uint64(len(chunk)) < frameLen(enc.Uint64(chunk)) {
+			if len(records) > 0 {
+				break
+			}
+			// the first frame does not fit in maxBytes
+			record, width, err := store.read(position)
+			if err != nil {
+				return nil, 0, err
+			}
+			return [][]byte{record}, position + width, nil
+		}
+		width := frameLen(enc.Uint64(chunk))
+		record, err := decodeFrame(chunk[:width], position)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, record)
+		chunk = chunk[width:]
+		position += width
+	}
+	return records, position, nil
+}
 
+// ReadFrame returns the uncompressed payload of the frame at position and the
+// position of the next frame, io.EOF once position is past the last frame.
+func (store *store) ReadFrame(position uint64) ([]byte, uint64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.buff.Flush(); err != nil {
+		return nil, 0, err
+	}
+	if position >= store.size {
+		return nil, 0, io.EOF
+	}
+	record, width, err := store.read(position)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	return record, position + width, nil
+}
+
+// Truncate drops everything in the store from position onwards.
+func (store *store) Truncate(position uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.buff.Flush(); err != nil {
+		return err
 	}
-	return record, nil
+	if err := store.File.Truncate(int64(position)); err != nil {
+		return err
+	}
+	store.size = position
+	return nil
 }
 
 func (store *store) ReadAt(b []byte, off int64) (int, error) {
@@ -88,6 +212,23 @@ func (store *store) ReadAt(b []byte, off int64) (int, error) {
 	return n, err
 }
 
+// Flush hands the buffered frames to the operating system.
+func (store *store) Flush() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.buff.Flush()
+}
+
+// Sync flushes the buffered frames and waits until they are on disk.
+func (store *store) Sync() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.buff.Flush(); err != nil {
+		return err
+	}
+	return store.File.Sync()
+}
+
 func (store *store) Close() error {
 	store.mu.Lock()
 	defer store.mu.Unlock()
@@ -97,3 +238,76 @@ func (store *store) Close() error {
 
 	return store.File.Close()
 }
+
+// encodeFrame returns b framed with its length and checksum.
+func encodeFrame(b []byte) []byte {
+	frame := make([]byte, frameWidth+uint64(len(b)))
+	enc.PutUint64(frame[:lenWidth], encodeFrameLen(frameVersionCRC, uint64(len(b))))
+	enc.PutUint32(frame[lenWidth:frameWidth], crc32.Checksum(b, crcTable))
+	copy(frame[frameWidth:], b)
+	return frame
+}
+
+func encodeCompressedFrame(codec Codec, compressed []byte) []byte {
+	frame := make([]byte, frameWidth+uint64(len(compressed)))
+	size := uint64(codec)<<frameCodecShift | uint64(len(compressed))&frameCompressedLenMask
+	enc.PutUint64(frame[:lenWidth], encodeFrameLen(frameVersionCompressed, size))
+	enc.PutUint32(frame[lenWidth:frameWidth], crc32.Checksum(compressed, crcTable))
+	copy(frame[frameWidth:], compressed)
+	return frame
+}
+
+// frameLen returns the number of bytes taken by the frame whose length word
+// is word.
+func frameLen(word uint64) uint64 {
+	version, size := decodeFrameLen(word)
+	switch version {
+	case frameVersionLegacy:
+		return lenWidth + size
+	case frameVersionCompressed:
+		return frameWidth + size&frameCompressedLenMask
+	default:
+		return frameWidth + size
+	}
+}
+
+// decodeFrame checks the whole frame read from position and returns its
+// uncompressed payload.
+func decodeFrame(frame []byte, position uint64) ([]byte, error) {
+	version, size := decodeFrameLen(enc.Uint64(frame))
+	switch version {
+	case frameVersionLegacy:
+		return frame[lenWidth:], nil
+	case frameVersionCRC:
+		record := frame[frameWidth:]
+		if enc.Uint32(frame[lenWidth:frameWidth]) != crc32.Checksum(record, crcTable) {
+			return nil, api.ErrCorruptRecord{Position: position, Reason: "checksum mismatch"}
+		}
+		return record, nil
+	case frameVersionCompressed:
+		codec := Codec(size >> frameCodecShift)
+		compressed := frame[frameWidth:]
+		if enc.Uint32(frame[lenWidth:frameWidth]) != crc32.Checksum(compressed, crcTable) {
+			return nil, api.ErrCorruptRecord{Position: position, Reason: "checksum mismatch"}
+		}
+		comp, err := codec.compressor()
+		if err != nil {
+			return nil, api.ErrCorruptRecord{Position: position, Reason: err.Error()}
+		}
+		record, err := comp.Decompress(compressed)
+		if err != nil {
+			return nil, api.ErrCorruptRecord{Position: position, Reason: "undecodable " + codec.String() + " payload"}
+		}
+		return record, nil
+	default:
+		return nil, api.ErrCorruptRecord{Position: position, Reason: "unknown frame version"}
+	}
+}
+
+func encodeFrameLen(version byte, size uint64) uint64 {
+	return uint64(version)<<frameVersionShift | size&frameLenMask
+}
+
+func decodeFrameLen(word uint64) (byte, uint64) {
+	return byte(word >> frameVersionShift), word & frameLenMask
+}
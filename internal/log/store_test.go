@@ -5,12 +5,13 @@ import (
 	"os"
 	"testing"
 
+	api "github.com/abdelwhab-1/proglog/api/v1"
 	"github.com/stretchr/testify/require"
 )
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + frameWidth
 )
 
 func TestStoreAppend(t *testing.T) {
@@ -32,6 +33,85 @@ func TestStoreAppend(t *testing.T) {
 
 }
 
+func TestStoreCorruption(t *testing.T) {
+	file, err := ioutil.TempFile("", "store_corruption_test")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	store, err := NewStore(file)
+	require.NoError(t, err)
+	_, pos, err := store.Append(write)
+	require.NoError(t, err)
+	_, err = store.Read(pos)
+	require.NoError(t, err)
+
+	// flip a byte of the payload behind the store's back
+	_, err = file.WriteAt([]byte{'H'}, int64(pos+frameWidth))
+	require.NoError(t, err)
+	_, err = store.Read(pos)
+	corrupt, ok := err.(api.ErrCorruptRecord)
+	require.True(t, ok)
+	require.Equal(t, pos, corrupt.Position)
+}
+
+func TestStoreReadFrames(t *testing.T) {
+	file, err := ioutil.TempFile("", "store_read_frames_test")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	store, err := NewStore(file)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, _, err := store.Append(write)
+		require.NoError(t, err)
+	}
+
+	frames, next, err := store.ReadFrames(0, 3*width-1, 10)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{write, write}, frames)
+	require.Equal(t, 2*width, next)
+
+	frames, next, err = store.ReadFrames(next, 10*width, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(frames))
+	require.Equal(t, 3*width, next)
+
+	// a frame larger than maxBytes is still returned on its own
+	frames, next, err = store.ReadFrames(next, 1, 10)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{write}, frames)
+	require.Equal(t, 4*width, next)
+
+	frames, _, err = store.ReadFrames(next, width, 10)
+	require.NoError(t, err)
+	require.Empty(t, frames)
+}
+
+func TestStoreReadLegacy(t *testing.T) {
+	file, err := ioutil.TempFile("", "store_legacy_test")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	// frames written before checksums were added: length then payload
+	legacy := make([]byte, lenWidth)
+	enc.PutUint64(legacy, uint64(len(write)))
+	_, err = file.Write(append(legacy, write...))
+	require.NoError(t, err)
+
+	store, err := NewStore(file)
+	require.NoError(t, err)
+	record, err := store.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, record)
+
+	_, pos, err := store.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, lenWidth+uint64(len(write)), pos)
+	record, err = store.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, record)
+}
+
 func testAppend(t *testing.T, store *store) {
 	t.Helper()
 	for i := uint64(1); i < 4; i++ {
@@ -66,7 +146,9 @@ func testReadAt(t *testing.T, s *store) {
 	require.NoError(t, err)
 	require.Equal(t, lenWidth, uint64(n))
 	off += int64(n)
-	size := enc.Uint64(b)
+	version, size := decodeFrameLen(enc.Uint64(b))
+	require.Equal(t, frameVersionCRC, version)
+	off += int64(crcWidth)
 	b = make([]byte, size)
 	n, err = s.ReadAt(b, off)
 	require.NoError(t, err)
@@ -0,0 +1,128 @@
+package log
+
+import (
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tysonmote/gommap"
+)
+
+var (
+	tsWidth      uint64 = 8
+	timeEntWidth        = tsWidth + idxWidth
+)
+
+// timeIndex is a sparse index from append time to relative offset. Every
+// entry holds the highest timestamp seen in the segment so far and the offset
+// of the record carrying it, so the timestamps only ever grow.
+type timeIndex struct {
+	File *os.File
+	size uint64
+	mmap gommap.MMap
+}
+
+func newTimeIndex(file *os.File, conf Config) (*timeIndex, error) {
+	idx := &timeIndex{
+		File: file,
+	}
+	fileInfo, err := idx.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	idx.size = uint64(fileInfo.Size())
+	// the time index never has more entries than the offset index
+	if err = os.Truncate(file.Name(), int64(conf.Sagment.MaxIndexBytes)); err != nil {
+		return nil, err
+	}
+	idx.mmap, err = gommap.Map(idx.File.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (idx *timeIndex) Close() error {
+	if err := idx.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return err
+	}
+	if err := idx.File.Sync(); err != nil {
+		return err
+	}
+	if err := idx.File.Truncate(int64(idx.size)); err != nil {
+		return err
+	}
+	return idx.File.Close()
+}
+
+func (idx *timeIndex) Write(ts int64, off uint32) error {
+	if uint64(len(idx.mmap)) < idx.size+timeEntWidth {
+		return io.EOF
+	}
+	enc.PutUint64(idx.mmap[idx.size:idx.size+tsWidth], uint64(ts))
+	enc.PutUint32(idx.mmap[idx.size+tsWidth:idx.size+timeEntWidth], off)
+	idx.size += timeEntWidth
+	return nil
+}
+
+func (idx *timeIndex) Read(entry int64) (ts int64, off uint32, err error) {
+	if idx.size == 0 {
+		return 0, 0, io.EOF
+	}
+	if entry == -1 {
+		entry = int64(idx.size/timeEntWidth) - 1
+	}
+	pos := uint64(entry) * timeEntWidth
+	if idx.size < pos+timeEntWidth {
+		return 0, 0, io.EOF
+	}
+	ts = int64(enc.Uint64(idx.mmap[pos : pos+tsWidth]))
+	off = enc.Uint32(idx.mmap[pos+tsWidth : pos+timeEntWidth])
+	return ts, off, nil
+}
+
+// Lookup returns the relative offset of the last entry older than ts, every
+// record before it is older than ts as well.
+func (idx *timeIndex) Lookup(ts int64) (uint32, bool) {
+	entries := int(idx.size / timeEntWidth)
+	i := sort.Search(entries, func(i int) bool {
+		got, _, _ := idx.Read(int64(i))
+		return got >= ts
+	})
+	if i == 0 {
+		return 0, false
+	}
+	_, off, err := idx.Read(int64(i - 1))
+	if err != nil {
+		return 0, false
+	}
+	return off, true
+}
+
+func (idx *timeIndex) Name() string {
+	return idx.File.Name()
+}
+
+// timeIndexer decides which records get a time index entry: one whose
+// timestamp is a new maximum, at most once every interval bytes of store.
+type timeIndexer struct {
+	interval uint64
+	maxTs    int64
+	lastPos  uint64
+	indexed  bool
+}
+
+// observe records a record written at pos and reports whether it needs an
+// entry in the time index.
+func (t *timeIndexer) observe(ts int64, pos uint64) bool {
+	if ts <= t.maxTs {
+		return false
+	}
+	t.maxTs = ts
+	if t.indexed && pos-t.lastPos < t.interval {
+		return false
+	}
+	t.indexed = true
+	t.lastPos = pos
+	return true
+}
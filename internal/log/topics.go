@@ -0,0 +1,309 @@
+package log
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+)
+
+// Topics manages named topics under Dir. A topic is split into partitions,
+// each one a log in its own directory under the topic's. Logs are opened on
+// first use and at most MaxOpen of them are kept open, the least recently used
+// idle one is closed when the limit is reached.
+type Topics struct {
+	Dir     string
+	Config  Config
+	MaxOpen int
+
+	mu         sync.Mutex
+	open       map[string]*openPartition
+	lru        *list.List
+	partitions map[string]uint32
+	next       map[string]uint32
+}
+
+type openPartition struct {
+	key  string
+	log  *log
+	refs int
+	elem *list.Element
+	// opened is closed once log is set, or err says why it couldn't be
+	// opened.
+	opened chan struct{}
+	err    error
+}
+
+func NewTopics(dir string, conf Config, maxOpen int) (*Topics, error) {
+	if maxOpen <= 0 {
+		maxOpen = 64
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Topics{
+		Dir:        dir,
+		Config:     conf,
+		MaxOpen:    maxOpen,
+		open:       make(map[string]*openPartition),
+		lru:        list.New(),
+		partitions: make(map[string]uint32),
+		next:       make(map[string]uint32),
+	}, nil
+}
+
+func validTopic(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+func partitionKey(name string, partition uint32) string {
+	return fmt.Sprintf("%s/%d", name, partition)
+}
+
+// Create makes the directories of a new topic and its partitions, the logs
+// themselves are opened lazily. A topic has at least one partition.
+func (t *Topics) Create(name string, partitions uint32) error {
+	if !validTopic(name) {
+		return api.ErrInvalidTopic{Topic: name}
+	}
+	if partitions == 0 {
+		partitions = 1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dir := path.Join(t.Dir, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		if os.IsExist(err) {
+			return api.ErrTopicExists{Topic: name}
+		}
+		return err
+	}
+	for p := uint32(0); p < partitions; p++ {
+		if err := os.Mkdir(path.Join(dir, strconv.Itoa(int(p))), 0755); err != nil {
+			return err
+		}
+	}
+	t.partitions[name] = partitions
+	return nil
+}
+
+// Delete removes a topic and all its partitions, it fails while any of the
+// partitions is in use.
+func (t *Topics) Delete(name string) error {
+	if !validTopic(name) {
+		return api.ErrInvalidTopic{Topic: name}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	partitions, err := t.partitionCount(name)
+	if err != nil {
+		return err
+	}
+	for p := uint32(0); p < partitions; p++ {
+		if part, ok := t.open[partitionKey(name, p)]; ok && part.refs > 0 {
+			return api.ErrTopicInUse{Topic: name}
+		}
+	}
+	for p := uint32(0); p < partitions; p++ {
+		if part, ok := t.open[partitionKey(name, p)]; ok {
+			if err := t.closePartition(part); err != nil {
+				return err
+			}
+		}
+	}
+	delete(t.partitions, name)
+	delete(t.next, name)
+	return os.RemoveAll(path.Join(t.Dir, name))
+}
+
+// List returns the names of every topic, open or not, in sorted order.
+func (t *Topics) List() ([]string, error) {
+	fsInfo, err := ioutil.ReadDir(t.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fInfo := range fsInfo {
+		if fInfo.IsDir() {
+			names = append(names, fInfo.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Partitions returns the number of partitions of a topic.
+func (t *Topics) Partitions(name string) (uint32, error) {
+	if !validTopic(name) {
+		return 0, api.ErrInvalidTopic{Topic: name}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.partitionCount(name)
+}
+
+// Partition picks the partition a record is produced to: records with a key
+// always go to the same partition so they stay ordered, the others are spread
+// round-robin.
+func (t *Topics) Partition(name string, key []byte) (uint32, error) {
+	if !validTopic(name) {
+		return 0, api.ErrInvalidTopic{Topic: name}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	partitions, err := t.partitionCount(name)
+	if err != nil {
+		return 0, err
+	}
+	if key != nil {
+		h := fnv.New32a()
+		h.Write(key)
+		return h.Sum32() % partitions, nil
+	}
+	p := t.next[name] % partitions
+	t.next[name] = p + 1
+	return p, nil
+}
+
+// partitionCount counts the partition directories of a topic once and
+// remembers the result.
+func (t *Topics) partitionCount(name string) (uint32, error) {
+	if partitions, ok := t.partitions[name]; ok {
+		return partitions, nil
+	}
+	fsInfo, err := ioutil.ReadDir(path.Join(t.Dir, name))
+	if os.IsNotExist(err) {
+		return 0, api.ErrTopicNotFound{Topic: name}
+	}
+	if err != nil {
+		return 0, err
+	}
+	var partitions uint32
+	for _, fInfo := range fsInfo {
+		if _, err := strconv.ParseUint(fInfo.Name(), 10, 32); err == nil && fInfo.IsDir() {
+			partitions++
+		}
+	}
+	if partitions == 0 {
+		return 0, api.ErrTopicNotFound{Topic: name}
+	}
+	t.partitions[name] = partitions
+	return partitions, nil
+}
+
+// Acquire returns the log of a topic's partition, opening it if needed. The
+// log stays open until release is called. A log is recovered without holding
+// the lock, the other partitions stay available meanwhile and acquirers of
+// the same one wait for it.
+func (t *Topics) Acquire(name string, partition uint32) (*log, func(), error) {
+	if !validTopic(name) {
+		return nil, nil, api.ErrInvalidTopic{Topic: name}
+	}
+	t.mu.Lock()
+	partitions, err := t.partitionCount(name)
+	if err != nil {
+		t.mu.Unlock()
+		return nil, nil, err
+	}
+	if partition >= partitions {
+		t.mu.Unlock()
+		return nil, nil, api.ErrPartitionNotFound{Topic: name, Partition: partition}
+	}
+	key := partitionKey(name, partition)
+	part, ok := t.open[key]
+	// the reference keeps the partition from being evicted or deleted
+	// while it is opened
+	if !ok {
+		part = &openPartition{key: key, refs: 1, opened: make(chan struct{})}
+		t.open[key] = part
+		t.mu.Unlock()
+		l, err := NewLog(path.Join(t.Dir, name, strconv.Itoa(int(partition))), t.Config)
+		t.mu.Lock()
+		part.log, part.err = l, err
+		close(part.opened)
+		if err == nil {
+			part.elem = t.lru.PushFront(part)
+		} else {
+			delete(t.open, key)
+		}
+	} else {
+		part.refs++
+		t.mu.Unlock()
+		<-part.opened
+		t.mu.Lock()
+	}
+	defer t.mu.Unlock()
+	if part.err != nil {
+		part.refs--
+		return nil, nil, part.err
+	}
+	t.lru.MoveToFront(part.elem)
+	if err := t.evict(); err != nil {
+		return nil, nil, err
+	}
+	var once sync.Once
+	return part.log, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			part.refs--
+			// a failed close is retried the next time the log is evicted
+			_ = t.evict()
+		})
+	}, nil
+}
+
+// evict closes idle logs, least recently used first, until at most MaxOpen
+// are open. Logs in use are skipped, so the limit may be exceeded for a while.
+func (t *Topics) evict() error {
+	for e := t.lru.Back(); e != nil && len(t.open) > t.MaxOpen; {
+		part := e.Value.(*openPartition)
+		e = e.Prev()
+		if part.refs > 0 {
+			continue
+		}
+		if err := t.closePartition(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Topics) closePartition(part *openPartition) error {
+	if err := part.log.Close(); err != nil {
+		return err
+	}
+	t.lru.Remove(part.elem)
+	delete(t.open, part.key)
+	return nil
+}
+
+// Close closes every open log, once those being opened are.
+func (t *Topics) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, part := range t.open {
+		if part.log == nil {
+			t.mu.Unlock()
+			<-part.opened
+			t.mu.Lock()
+		}
+	}
+	for _, part := range t.open {
+		if part.log == nil {
+			continue
+		}
+		if err := t.closePartition(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topics_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(dir, Config{}, 2)
+	require.NoError(t, err)
+	defer topics.Close()
+
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		require.Equal(t, api.ErrInvalidTopic{Topic: name}, topics.Create(name, 1))
+	}
+	for _, name := range []string{"payments", "metrics", "audit"} {
+		require.NoError(t, topics.Create(name, 1))
+	}
+	require.Equal(t, api.ErrTopicExists{Topic: "audit"}, topics.Create("audit", 1))
+	names, err := topics.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"audit", "metrics", "payments"}, names)
+
+	_, _, err = topics.Acquire("missing", 0)
+	require.Equal(t, api.ErrTopicNotFound{Topic: "missing"}, err)
+
+	// every topic gets its own offsets
+	for _, name := range names {
+		l, release, err := topics.Acquire(name, 0)
+		require.NoError(t, err)
+		off, err := l.Append(&api.Record{Value: []byte(name)})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+		release()
+	}
+	// only the two most recently used logs stay open
+	require.Equal(t, 2, len(topics.open))
+	require.NotContains(t, topics.open, "audit/0")
+
+	l, release, err := topics.Acquire("audit", 0)
+	require.NoError(t, err)
+	red, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("audit"), red.Value)
+
+	require.Equal(t, api.ErrTopicInUse{Topic: "audit"}, topics.Delete("audit"))
+	release()
+	require.NoError(t, topics.Delete("audit"))
+	require.Equal(t, api.ErrTopicNotFound{Topic: "audit"}, topics.Delete("audit"))
+	names, err = topics.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"metrics", "payments"}, names)
+}
+
+func TestTopicsLimitWhileInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topics_in_use_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(dir, Config{}, 1)
+	require.NoError(t, err)
+	defer topics.Close()
+
+	require.NoError(t, topics.Create("a", 1))
+	require.NoError(t, topics.Create("b", 1))
+	a, releaseA, err := topics.Acquire("a", 0)
+	require.NoError(t, err)
+	_, releaseB, err := topics.Acquire("b", 0)
+	require.NoError(t, err)
+	// both are in use, so neither can be closed yet
+	require.Equal(t, 2, len(topics.open))
+	_, err = a.Append(&api.Record{Value: []byte("still open")})
+	require.NoError(t, err)
+
+	releaseA()
+	require.Equal(t, 1, len(topics.open))
+	require.Contains(t, topics.open, "b/0")
+	releaseB()
+	releaseB()
+	require.Equal(t, 1, len(topics.open))
+}
+
+func TestTopicsAcquireWhileOpening(t *testing.T) {
+	topics, err := NewTopics(t.TempDir(), Config{}, 0)
+	require.NoError(t, err)
+	defer topics.Close()
+	require.NoError(t, topics.Create("a", 1))
+	require.NoError(t, topics.Create("b", 1))
+
+	// a partition being opened holds back its own acquirers only
+	opening := &openPartition{key: "a/0", refs: 1, opened: make(chan struct{})}
+	topics.open["a/0"] = opening
+	acquired := make(chan *log)
+	go func() {
+		l, release, err := topics.Acquire("a", 0)
+		require.NoError(t, err)
+		defer release()
+		acquired <- l
+	}()
+	_, releaseB, err := topics.Acquire("b", 0)
+	require.NoError(t, err)
+	releaseB()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a partition before it was opened")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	l, err := NewLog(t.TempDir(), Config{})
+	require.NoError(t, err)
+	topics.mu.Lock()
+	opening.log = l
+	opening.elem = topics.lru.PushFront(opening)
+	close(opening.opened)
+	topics.mu.Unlock()
+	require.Equal(t, l, <-acquired)
+
+	// concurrent acquirers share the log opened once
+	require.NoError(t, topics.Create("c", 1))
+	var wg sync.WaitGroup
+	logs := make([]*log, 8)
+	for i := range logs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l, release, err := topics.Acquire("c", 0)
+			require.NoError(t, err)
+			defer release()
+			logs[i] = l
+		}(i)
+	}
+	wg.Wait()
+	for _, l := range logs {
+		require.Equal(t, logs[0], l)
+	}
+}
+
+func TestTopicsPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "topics_partitions_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	topics, err := NewTopics(dir, Config{}, 0)
+	require.NoError(t, err)
+	defer topics.Close()
+
+	require.NoError(t, topics.Create("orders", 3))
+	_, _, err = topics.Acquire("orders", 3)
+	require.Equal(t, api.ErrPartitionNotFound{Topic: "orders", Partition: 3}, err)
+
+	key := []byte("customer-1")
+	want, err := topics.Partition("orders", key)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		got, err := topics.Partition("orders", key)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	for i := uint32(0); i < 6; i++ {
+		got, err := topics.Partition("orders", nil)
+		require.NoError(t, err)
+		require.Equal(t, i%3, got)
+	}
+
+	// the partition count is read back from disk
+	reopened, err := NewTopics(dir, Config{}, 0)
+	require.NoError(t, err)
+	partitions, err := reopened.Partitions("orders")
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), partitions)
+	_, err = reopened.Partitions("missing")
+	require.Equal(t, api.ErrTopicNotFound{Topic: "missing"}, err)
+}
@@ -0,0 +1,41 @@
+package log
+
+import "time"
+
+// worker runs a periodic background task owned by the log until it is
+// stopped.
+type worker struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startWorker(interval time.Duration, fn func(now time.Time)) *worker {
+	w := &worker{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case now := <-ticker.C:
+				fn(now)
+			}
+		}
+	}()
+	return w
+}
+
+// Stop waits for a running task to finish, it is safe to call more than once.
+func (w *worker) Stop() {
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	<-w.done
+}
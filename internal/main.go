@@ -1,12 +1,145 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 
+	"github.com/abdelwhab-1/proglog/internal/config"
+	plog "github.com/abdelwhab-1/proglog/internal/log"
 	"github.com/abdelwhab-1/proglog/internal/server"
+	"google.golang.org/grpc"
 )
 
 func main() {
-	srv := server.NewHTTPServer(":8080")
-	log.Fatal(srv.ListenAndServe())
+	addr := flag.String("addr", ":8080", "address the HTTP server listens on")
+	rpcAddr := flag.String("rpc-addr", "127.0.0.1:8400", "address the gRPC server listens on")
+	dataDir := flag.String("data-dir", filepath.Join(os.TempDir(), "proglog"), "directory the logs are kept in")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate both servers present")
+	tlsKey := flag.String("tls-key", "", "PEM key of the certificate")
+	tlsCA := flag.String("tls-ca", "", "PEM CA clients must present a certificate signed by")
+	insecureDev := flag.Bool("insecure-dev", false, "serve plaintext without TLS, for development only")
+	flag.Parse()
+
+	var tlsConfig *config.TLSConfig
+	if *insecureDev {
+		log.Print("serving plaintext, -insecure-dev is for development only")
+	} else {
+		if *tlsCert == "" || *tlsKey == "" || *tlsCA == "" {
+			log.Fatal("-tls-cert, -tls-key and -tls-ca are required, pass -insecure-dev to serve plaintext")
+		}
+		tlsConfig = &config.TLSConfig{CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA}
+	}
+
+	logDir := filepath.Join(*dataDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	clog, err := plog.NewLog(logDir, plog.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer clog.Close()
+	for _, r := range clog.Recovered() {
+		log.Printf("recovered segment %d: kept %d records, truncated %d bytes (%v), index rebuilt %t, time index rebuilt %t",
+			r.BaseOffset, r.Records, r.TruncatedBytes, r.Corruption, r.IndexRebuilt, r.TimeIndexRebuilt)
+	}
+	topics, err := plog.NewTopics(filepath.Join(*dataDir, "topics"), plog.Config{}, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer topics.Close()
+	offsetDir := filepath.Join(*dataDir, "offsets")
+	if err := os.MkdirAll(offsetDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	offsetConfig := plog.Config{}
+	offsetConfig.Compaction.Enabled = true
+	offsetLog, err := plog.NewLog(offsetDir, offsetConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer offsetLog.Close()
+	conf := &server.Config{
+		CommitLog: clog,
+		Topics:    server.NewTopicManager(topics),
+		OffsetLog: offsetLog,
+		TLS:       tlsConfig,
+	}
+	if tlsConfig != nil {
+		// the gateway calls on behalf of the HTTP clients with the
+		// server's certificate
+		subject, err := commonName(tlsConfig.CertFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conf.Proxies = []string{subject}
+	}
+
+	gsrv, err := server.NewGRPCServer(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := net.Listen("tcp", *rpcAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		log.Fatal(gsrv.Serve(l))
+	}()
+
+	// the gateway dials the gRPC server with the same certificate
+	dialOpt := grpc.WithInsecure()
+	if tlsConfig != nil {
+		creds, err := config.ClientCredentials(*tlsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dialOpt = grpc.WithTransportCredentials(creds)
+	}
+	// the gateway serves the annotated RPCs under /v1 for generated clients
+	// and topic and group management, the hand-written endpoints are the
+	// HTTP API to produce and consume, see server.NewHTTPServer
+	gateway, err := server.NewGatewayHandler(context.Background(), l.Addr().String(), dialOpt)
+	if err != nil {
+		log.Fatal(err)
+	}
+	srv := server.NewHTTPServer(*addr, conf)
+	mux := http.NewServeMux()
+	mux.Handle("/v1/", gateway)
+	mux.Handle("/", srv.Handler)
+	srv.Handler = mux
+	if tlsConfig == nil {
+		log.Fatal(srv.ListenAndServe())
+	}
+	serverTLS := *tlsConfig
+	serverTLS.Server = true
+	if srv.TLSConfig, err = config.SetupTLSConfig(serverTLS); err != nil {
+		log.Fatal(err)
+	}
+	// the certificate is in srv.TLSConfig already
+	log.Fatal(srv.ListenAndServeTLS("", ""))
+}
+
+func commonName(certFile string) (string, error) {
+	b, err := os.ReadFile(certFile)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return "", fmt.Errorf("no certificate in %q", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return cert.Subject.CommonName, nil
 }
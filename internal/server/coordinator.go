@@ -0,0 +1,296 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AssignmentStrategy divides the partitions of the subscribed topics among
+// the members of a group. members maps a member id to its topics, the result
+// maps a member id to the partitions of each topic it owns.
+type AssignmentStrategy func(members map[string][]string, partitions map[string]uint32) map[string]map[string][]uint32
+
+var strategies = map[string]AssignmentStrategy{
+	"range":      RangeAssignment,
+	"roundrobin": RoundRobinAssignment,
+}
+
+// RangeAssignment gives every member subscribed to a topic a contiguous range
+// of its partitions, the first members get one more when they do not divide
+// evenly.
+func RangeAssignment(members map[string][]string, partitions map[string]uint32) map[string]map[string][]uint32 {
+	assignment := emptyAssignment(members)
+	for topic, count := range partitions {
+		subscribed := subscribers(members, topic)
+		if len(subscribed) == 0 {
+			continue
+		}
+		per := count / uint32(len(subscribed))
+		extra := count % uint32(len(subscribed))
+		var next uint32
+		for i, id := range subscribed {
+			n := per
+			if uint32(i) < extra {
+				n++
+			}
+			for p := next; p < next+n; p++ {
+				assignment[id][topic] = append(assignment[id][topic], p)
+			}
+			next += n
+		}
+	}
+	return assignment
+}
+
+// RoundRobinAssignment deals the partitions of every topic, in topic order,
+// to the members subscribed to it one at a time.
+func RoundRobinAssignment(members map[string][]string, partitions map[string]uint32) map[string]map[string][]uint32 {
+	assignment := emptyAssignment(members)
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	topics := make([]string, 0, len(partitions))
+	for topic := range partitions {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	next := 0
+	for _, topic := range topics {
+		if len(subscribers(members, topic)) == 0 {
+			continue
+		}
+		for p := uint32(0); p < partitions[topic]; p++ {
+			for {
+				id := ids[next%len(ids)]
+				next++
+				if subscribes(members[id], topic) {
+					assignment[id][topic] = append(assignment[id][topic], p)
+					break
+				}
+			}
+		}
+	}
+	return assignment
+}
+
+func emptyAssignment(members map[string][]string) map[string]map[string][]uint32 {
+	assignment := make(map[string]map[string][]uint32, len(members))
+	for id := range members {
+		assignment[id] = make(map[string][]uint32)
+	}
+	return assignment
+}
+
+func subscribes(topics []string, topic string) bool {
+	for _, t := range topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+func subscribers(members map[string][]string, topic string) []string {
+	var ids []string
+	for id, topics := range members {
+		if subscribes(topics, topic) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// coordinator tracks the members of every consumer group. Members keep their
+// session alive with heartbeats, whenever one joins, leaves or expires the
+// group's partitions are reassigned and pushed to every member.
+type coordinator struct {
+	sessionTimeout time.Duration
+	partitions     func(topic string) (uint32, error)
+
+	mu     sync.Mutex
+	groups map[string]*consumerGroup
+	nextID uint64
+}
+
+type consumerGroup struct {
+	name       string
+	strategy   string
+	generation uint64
+	members    map[string]*groupMember
+}
+
+type groupMember struct {
+	id     string
+	topics []string
+	timer  *time.Timer
+	// assignments only holds the latest assignment, an older one nobody
+	// received yet is replaced.
+	assignments chan *api.Assignment
+	expired     chan struct{}
+}
+
+func newCoordinator(sessionTimeout time.Duration, partitions func(string) (uint32, error)) *coordinator {
+	return &coordinator{
+		sessionTimeout: sessionTimeout,
+		partitions:     partitions,
+		groups:         make(map[string]*consumerGroup),
+	}
+}
+
+// Join adds a member to a group, or replaces the member with the same id, and
+// rebalances the group.
+func (c *coordinator) Join(name, id string, topics []string, strategy string) (*groupMember, error) {
+	if strategy == "" {
+		strategy = "range"
+	}
+	if _, ok := strategies[strategy]; !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown assignment strategy %q", strategy)
+	}
+	for _, topic := range topics {
+		if _, err := c.partitions(topic); err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	group, ok := c.groups[name]
+	if !ok {
+		group = &consumerGroup{
+			name:     name,
+			strategy: strategy,
+			members:  make(map[string]*groupMember),
+		}
+		c.groups[name] = group
+	}
+	if group.strategy != strategy {
+		return nil, status.Errorf(codes.InvalidArgument, "group %q uses the %q strategy", name, group.strategy)
+	}
+	if id == "" {
+		c.nextID++
+		id = fmt.Sprintf("member-%d", c.nextID)
+	}
+	if old, ok := group.members[id]; ok {
+		c.remove(group, old)
+	}
+	m := &groupMember{
+		id:          id,
+		topics:      topics,
+		assignments: make(chan *api.Assignment, 1),
+		expired:     make(chan struct{}),
+	}
+	m.timer = time.AfterFunc(c.sessionTimeout, func() { c.expire(name, m) })
+	group.members[id] = m
+	c.rebalance(group)
+	return m, nil
+}
+
+// Topics returns the topics a member subscribed to.
+func (c *coordinator) Topics(name, id string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.member(name, id)
+	if err != nil {
+		return nil, err
+	}
+	return m.topics, nil
+}
+
+// Heartbeat renews a member's session and returns the group's generation.
+func (c *coordinator) Heartbeat(name, id string) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.member(name, id)
+	if err != nil {
+		return 0, err
+	}
+	m.timer.Reset(c.sessionTimeout)
+	return c.groups[name].generation, nil
+}
+
+// member looks a member up, it is called with mu held.
+func (c *coordinator) member(name, id string) (*groupMember, error) {
+	group, ok := c.groups[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown member %q of group %q", id, name)
+	}
+	m, ok := group.members[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown member %q of group %q", id, name)
+	}
+	return m, nil
+}
+
+// Leave removes a member from its group, it is a no-op when the member has
+// already expired or been replaced.
+func (c *coordinator) Leave(name string, m *groupMember) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	group, ok := c.groups[name]
+	if !ok || group.members[m.id] != m {
+		return
+	}
+	c.remove(group, m)
+	if len(group.members) == 0 {
+		delete(c.groups, name)
+		return
+	}
+	c.rebalance(group)
+}
+
+func (c *coordinator) expire(name string, m *groupMember) {
+	c.Leave(name, m)
+}
+
+func (c *coordinator) remove(group *consumerGroup, m *groupMember) {
+	m.timer.Stop()
+	close(m.expired)
+	delete(group.members, m.id)
+}
+
+// rebalance computes a new generation of the group's assignment and pushes
+// it to every member.
+func (c *coordinator) rebalance(group *consumerGroup) {
+	members := make(map[string][]string, len(group.members))
+	partitions := make(map[string]uint32)
+	for id, m := range group.members {
+		members[id] = m.topics
+		for _, topic := range m.topics {
+			if _, ok := partitions[topic]; ok {
+				continue
+			}
+			// a deleted topic counts as one without partitions
+			count, _ := c.partitions(topic)
+			partitions[topic] = count
+		}
+	}
+	group.generation++
+	assignment := strategies[group.strategy](members, partitions)
+	for id, m := range group.members {
+		a := &api.Assignment{MemberId: id, Generation: group.generation}
+		topics := make([]string, 0, len(assignment[id]))
+		for topic := range assignment[id] {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		for _, topic := range topics {
+			a.Partitions = append(a.Partitions, &api.TopicPartitions{
+				Topic:      topic,
+				Partitions: assignment[id][topic],
+			})
+		}
+		select {
+		case <-m.assignments:
+		default:
+		}
+		m.assignments <- a
+	}
+}
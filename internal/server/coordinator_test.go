@@ -0,0 +1,62 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssignmentStrategies(t *testing.T) {
+	members := map[string][]string{
+		"a": {"orders", "payments"},
+		"b": {"orders", "payments"},
+		"c": {"orders"},
+	}
+	partitions := map[string]uint32{"orders": 5, "payments": 3}
+
+	require.Equal(t, map[string]map[string][]uint32{
+		"a": {"orders": {0, 1}, "payments": {0, 1}},
+		"b": {"orders": {2, 3}, "payments": {2}},
+		"c": {"orders": {4}},
+	}, RangeAssignment(members, partitions))
+
+	require.Equal(t, map[string]map[string][]uint32{
+		"a": {"orders": {0, 3}, "payments": {0, 2}},
+		"b": {"orders": {1, 4}, "payments": {1}},
+		"c": {"orders": {2}},
+	}, RoundRobinAssignment(members, partitions))
+}
+
+func TestCoordinatorExpiry(t *testing.T) {
+	c := newCoordinator(50*time.Millisecond, func(string) (uint32, error) { return 2, nil })
+
+	alive, err := c.Join("billing", "alive", []string{"orders"}, "")
+	require.NoError(t, err)
+	dead, err := c.Join("billing", "dead", []string{"orders"}, "")
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0}, (<-alive.assignments).Partitions[0].Partitions)
+
+	_, err = c.Join("billing", "other", []string{"orders"}, "roundrobin")
+	require.Error(t, err)
+
+	// only one member keeps sending heartbeats
+	var assignment *api.Assignment
+	require.Eventually(t, func() bool {
+		_, err := c.Heartbeat("billing", "alive")
+		require.NoError(t, err)
+		select {
+		case assignment = <-alive.assignments:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+	<-dead.expired
+	require.Equal(t, uint64(3), assignment.Generation)
+	require.Equal(t, []uint32{0, 1}, assignment.Partitions[0].Partitions)
+
+	_, err = c.Heartbeat("billing", "dead")
+	require.Error(t, err)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// followerRetry is how long a follower waits before it reconnects after the
+// stream from its leader broke.
+const followerRetry = time.Second
+
+// ReplicaLog is a follower's copy of its leader's default log.
+type ReplicaLog interface {
+	CommitLog
+	// AppendAt appends a record at the offset it already has.
+	AppendAt(*api.Record) error
+	HighestOffset() (uint64, error)
+}
+
+var _ CommitLog = (*Follower)(nil)
+
+// Follower pulls its leader's default log into a local log, with the same
+// offsets, and serves reads from it. It can be used as the CommitLog of a
+// server, which then refuses to produce.
+type Follower struct {
+	ReplicaLog
+	id     string
+	client api.LogClient
+
+	lag    uint64
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewFollower starts replicating the leader's log to local, from the end of
+// local on.
+func NewFollower(id string, local ReplicaLog, leader api.LogClient) *Follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Follower{
+		ReplicaLog: local,
+		id:         id,
+		client:     leader,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go f.run(ctx)
+	return f
+}
+
+func (f *Follower) Append(*api.Record) (uint64, error) {
+	return 0, status.Error(codes.FailedPrecondition, "followers do not accept records")
+}
+
+func (f *Follower) AppendBatch([]*api.Record) (uint64, uint64, error) {
+	return 0, 0, status.Error(codes.FailedPrecondition, "followers do not accept records")
+}
+
+// Lag returns how many offsets the follower was behind its leader when it
+// last heard from it.
+func (f *Follower) Lag() uint64 {
+	return atomic.LoadUint64(&f.lag)
+}
+
+// Close stops replicating, the local log is left open.
+func (f *Follower) Close() error {
+	f.cancel()
+	<-f.done
+	return nil
+}
+
+func (f *Follower) run(ctx context.Context) {
+	defer close(f.done)
+	for {
+		// the stream is opened again from wherever the local log ends
+		_ = f.replicate(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(followerRetry):
+		}
+	}
+}
+
+func (f *Follower) replicate(ctx context.Context) error {
+	next, err := f.next()
+	if err != nil {
+		return err
+	}
+	stream, err := f.client.Replicate(ctx)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&api.ReplicateRequest{FollowerId: f.id, OffSet: next}); err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		for _, record := range res.Records {
+			if err := f.ReplicaLog.AppendAt(record); err != nil {
+				return err
+			}
+			next = record.Offset + 1
+		}
+		var lag uint64
+		if res.HighestOffSet >= next {
+			lag = res.HighestOffSet + 1 - next
+		}
+		atomic.StoreUint64(&f.lag, lag)
+		if err := stream.Send(&api.ReplicateRequest{FollowerId: f.id, OffSet: next}); err != nil {
+			return err
+		}
+	}
+}
+
+// next returns the offset after the last record of the local log.
+func (f *Follower) next() (uint64, error) {
+	highest, err := f.ReplicaLog.HighestOffset()
+	if err != nil {
+		return 0, err
+	}
+	// HighestOffset is 0 for an empty log as well
+	if _, err := f.ReplicaLog.Read(highest); err != nil {
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			return highest, nil
+		}
+		return 0, err
+	}
+	return highest + 1, nil
+}
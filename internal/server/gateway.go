@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// NewGatewayHandler serves the HTTP mappings of the log service in
+// api/v1/log.proto by translating them to calls to the gRPC server at
+// endpoint, so every annotated RPC gets a JSON API without more code. The
+// connection, dialed with opts, is closed once ctx is done. The calls forward
+// the subject of the HTTP client, the server authorizes them as that subject
+// when the certificate the gateway dials with is one of its Proxies.
+func NewGatewayHandler(ctx context.Context, endpoint string, opts ...grpc.DialOption) (http.Handler, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(gatewayHeader),
+		runtime.WithMetadata(func(ctx context.Context, r *http.Request) metadata.MD {
+			return metadata.Pairs(subjectMetadata, httpSubject(r))
+		}),
+	)
+	if err := api.RegisterLogHandlerFromEndpoint(ctx, mux, endpoint, opts); err != nil {
+		return nil, err
+	}
+	return mux, nil
+}
+
+// gatewayHeader forwards the headers the default matcher does, except for a
+// Grpc-Metadata-Proglog-Subject a client could claim another subject with.
+func gatewayHeader(key string) (string, bool) {
+	name, ok := runtime.DefaultHeaderMatcher(key)
+	if !ok || strings.EqualFold(name, subjectMetadata) {
+		return "", false
+	}
+	return name, true
+}
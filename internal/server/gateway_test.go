@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"github.com/abdelwhab-1/proglog/internal/auth"
+	"github.com/abdelwhab-1/proglog/internal/config"
+	"github.com/abdelwhab-1/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestGateway(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	topics, err := log.NewTopics(t.TempDir(), log.Config{}, 0)
+	require.NoError(t, err)
+	defer topics.Close()
+	gsrv, err := NewGRPCServer(&Config{CommitLog: clog, Topics: topicManager{topics}})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+	defer gsrv.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gateway, err := NewGatewayHandler(ctx, l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	srv := httptest.NewServer(gateway)
+	defer srv.Close()
+
+	do := func(method, path, body string, resp interface{}) int {
+		req, err := http.NewRequestWithContext(ctx, method, srv.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		if resp != nil {
+			require.NoError(t, json.NewDecoder(res.Body).Decode(resp))
+		}
+		return res.StatusCode
+	}
+
+	// values are base64 and 64 bit integers strings, as in proto3 JSON
+	var produce struct {
+		OffSet string `json:"offSet"`
+	}
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/v1/records", `{"record":{"value":"aGVsbG8="}}`, nil))
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/v1/records", `{"record":{"value":"d29ybGQ="}}`, &produce))
+	require.Equal(t, "1", produce.OffSet)
+
+	var consume struct {
+		Record struct {
+			Value  []byte `json:"value"`
+			Offset string `json:"offset"`
+		} `json:"record"`
+	}
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/v1/records/1", "", &consume))
+	require.Equal(t, []byte("world"), consume.Record.Value)
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/v1/records/2", "", nil))
+
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/v1/topics", `{"topic":"orders","partitions":2}`, nil))
+	var list struct {
+		Topics []string `json:"topics"`
+	}
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/v1/topics", "", &list))
+	require.Equal(t, []string{"orders"}, list.Topics)
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/v1/topics/orders/records", `{"record":{"value":"aGVsbG8="}}`, nil))
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "/v1/topics/orders", "", nil))
+
+	// server streams come as a result per line
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/v1/stream?offSet=0", nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	lines := bufio.NewScanner(res.Body)
+	for _, want := range []string{"hello", "world"} {
+		require.True(t, lines.Scan())
+		var msg struct {
+			Result struct {
+				Record struct {
+					Value []byte `json:"value"`
+				} `json:"record"`
+			} `json:"result"`
+		}
+		require.NoError(t, json.Unmarshal(lines.Bytes(), &msg))
+		require.Equal(t, []byte(want), msg.Result.Record.Value)
+	}
+}
+
+func TestGatewayAuthorization(t *testing.T) {
+	caFile, certs, err := config.GenerateCerts(t.TempDir(), "server", "root", "nobody")
+	require.NoError(t, err)
+	policyFile := filepath.Join(t.TempDir(), "policy.csv")
+	require.NoError(t, os.WriteFile(policyFile, []byte("p, root, /, produce\n"), 0600))
+	authorizer, err := auth.New("", policyFile)
+	require.NoError(t, err)
+	tlsConfig := func(name string) config.TLSConfig {
+		return config.TLSConfig{CertFile: certs[name].CertFile, KeyFile: certs[name].KeyFile, CAFile: caFile}
+	}
+
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	serverTLS := tlsConfig("server")
+	conf := &Config{
+		CommitLog:  clog,
+		TLS:        &serverTLS,
+		Authorizer: authorizer,
+		Proxies:    []string{"server"},
+	}
+	gsrv, err := NewGRPCServer(conf)
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+	defer gsrv.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	creds, err := config.ClientCredentials(serverTLS)
+	require.NoError(t, err)
+	gateway, err := NewGatewayHandler(ctx, l.Addr().String(), grpc.WithTransportCredentials(creds))
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.Handle("/v1/", gateway)
+	mux.Handle("/", NewHTTPServer(":0", conf).Handler)
+	srv := httptest.NewUnstartedServer(mux)
+	serverTLS.Server = true
+	srv.TLS, err = config.SetupTLSConfig(serverTLS)
+	require.NoError(t, err)
+	srv.StartTLS()
+	defer srv.Close()
+
+	// both HTTP APIs authorize the subject of the client's certificate
+	produce := func(name, path string, header ...string) int {
+		clientTLS, err := config.SetupTLSConfig(tlsConfig(name))
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+		defer client.CloseIdleConnections()
+		req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(`{"record":{"value":"aGVsbG8="}}`))
+		require.NoError(t, err)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Add(header[i], header[i+1])
+		}
+		res, err := client.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		return res.StatusCode
+	}
+	require.Equal(t, http.StatusOK, produce("root", "/v1/records"))
+	require.Equal(t, http.StatusForbidden, produce("nobody", "/v1/records"))
+	require.Equal(t, http.StatusCreated, produce("root", "/records"))
+	require.Equal(t, http.StatusForbidden, produce("nobody", "/records"))
+	// a client can't claim a subject through the gateway's metadata headers
+	require.Equal(t, http.StatusForbidden, produce("nobody", "/v1/records", "Grpc-Metadata-Proglog-Subject", "root"))
+	require.Equal(t, http.StatusForbidden, produce("nobody", "/v1/records", "grpc-metadata-proglog-subject", "root"))
+
+	// only proxies forward a subject, exactly one, and never act as
+	// themselves
+	dial := func(name string) api.LogClient {
+		creds, err := config.ClientCredentials(tlsConfig(name))
+		require.NoError(t, err)
+		conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(creds))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return api.NewLogClient(conn)
+	}
+	req := &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}}
+	forged := metadata.AppendToOutgoingContext(ctx, subjectMetadata, "root")
+	_, err = dial("nobody").Produce(forged, req)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	proxy := dial("server")
+	_, err = proxy.Produce(ctx, req)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	twice := metadata.AppendToOutgoingContext(ctx, subjectMetadata, "nobody", subjectMetadata, "root")
+	_, err = proxy.Produce(twice, req)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = proxy.Produce(forged, req)
+	require.NoError(t, err)
+}
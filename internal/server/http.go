@@ -1,92 +1,357 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
+	api "github.com/abdelwhab-1/proglog/api/v1"
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func NewHTTPServer(address string) *http.Server {
-	httpserver := newHTTPServer()
+// NewHTTPServer serves the logs of conf over JSON, they are the same logs the
+// gRPC server uses so both see the same records. Named topics live under
+// /topics/{topic}/records and the default log under /records. The subject of
+// a client is the common name of the certificate it presents over HTTPS, it
+// is empty without one.
+//
+// These routes are the canonical HTTP API to produce and consume: they use
+// plain JSON, page through records, resume Server-Sent Events and speak
+// WebSocket, none of which the gateway does. The gateway under /v1 stays for
+// clients generated from log.proto, which expect the proto3 JSON of the gRPC
+// service, and is the only HTTP API to manage topics and groups.
+func NewHTTPServer(address string, conf *Config) *http.Server {
+	httpserver := newHTTPServer(conf)
 	router := mux.NewRouter()
-	router.HandleFunc("/", httpserver.handleProduce).Methods("POST")
-	router.HandleFunc("/", httpserver.handleConsume).Methods("GET")
+	for _, prefix := range []string{"/topics/{topic}", ""} {
+		router.HandleFunc(prefix+"/records", httpserver.handleProduce).Methods("POST")
+		router.HandleFunc(prefix+"/records", httpserver.handleConsumeRange).Methods("GET")
+		router.HandleFunc(prefix+"/records/{offset:[0-9]+}", httpserver.handleConsume).Methods("GET")
+		router.HandleFunc(prefix+"/records/stream", httpserver.handleConsumeStream).Methods("GET")
+	}
+	router.HandleFunc("/ws", httpserver.handleWebSocket).Methods("GET")
 	return &http.Server{
 		Addr:    address,
-		Handler: router,
+		Handler: authenticateHTTP(router),
+	}
+}
+
+// authenticateHTTP adds the subject of the client to the context of its
+// requests, as authenticate does for gRPC.
+func authenticateHTTP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), subjectContextKey{}, httpSubject(r))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// httpSubject returns the common name of the certificate the client presented.
+func httpSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
 	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
 }
 
 type httpServer struct {
-	log *Log
+	*Config
 }
 
-func newHTTPServer() *httpServer {
+func newHTTPServer(conf *Config) *httpServer {
 	return &httpServer{
-		log: NewLog(),
+		Config: conf,
+	}
+}
+
+func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
+	topic := mux.Vars(r)["topic"]
+	var produceRequest ProduceRequest
+	if err := json.NewDecoder(r.Body).Decode(&produceRequest); err != nil {
+		writeError(w, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+	if produceRequest.Record == nil {
+		writeError(w, status.Error(codes.InvalidArgument, "record is required"))
+		return
+	}
+	offs, partition, err := s.produce(r.Context(), topic, produceRequest.Record)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+	writeJSON(w, http.StatusCreated, ProductResponse{Offset: offs, Partition: partition})
+}
+
+func (s *httpServer) produce(ctx context.Context, topic string, record *api.Record) (uint64, uint32, error) {
+	if err := s.authorize(ctx, topic, produceAction); err != nil {
+		return 0, 0, err
+	}
+	clog, partition, release, err := s.route(topic, record.Key)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+	offs, err := clog.Append(record)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := s.waitReplicas(ctx, topic, offs); err != nil {
+		return 0, 0, err
+	}
+	return offs, partition, nil
 }
 
 func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
-	var consumeRequest ConsumeRequest
-	err := json.NewDecoder(r.Body).Decode(&consumeRequest)
+	offset, err := strconv.ParseUint(mux.Vars(r)["offset"], 10, 64)
+	if err != nil {
+		writeError(w, status.Error(codes.InvalidArgument, "invalid offset"))
+		return
+	}
+	clog, release, err := s.consumeLog(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer release()
+	rec, err := clog.Read(offset)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ConsumeResponse{Record: rec})
+}
+
+// handleConsumeRange returns a page of up to limit records from the offset
+// from on, an empty page means there are no records at from yet, or that
+// compaction removed them when next moved past from. An offset retention
+// already removed is NotFound, so a client paging through the log learns
+// that it missed records.
+func (s *httpServer) handleConsumeRange(w http.ResponseWriter, r *http.Request) {
+	from, err := queryUint(r, "from", 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	limit, err := queryUint(r, "limit", defaultFetchRecords)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if limit == 0 || limit > defaultFetchRecords {
+		limit = defaultFetchRecords
+	}
+	clog, release, err := s.consumeLog(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err)
+		return
+	}
+	defer release()
+	next := from
+	records, err := clog.ReadBatch(from, int(limit), defaultFetchBytes)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok && !appended(clog, from) {
+		records, err = []*api.Record{}, nil
+	} else if err == nil && len(records) == 0 {
+		// the records from there on were compacted
+		records = []*api.Record{}
+		next++
 	}
-	rec, err := s.log.Read(consumeRequest.Offset)
 	if err != nil {
-		if err == ErrOffsetNotFound {
-			http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, err)
+		return
+	}
+	if len(records) > 0 {
+		next = records[len(records)-1].Offset + 1
+	}
+	writeJSON(w, http.StatusOK, RecordsResponse{Records: records, Next: next})
+}
+
+// handleConsumeStream sends the records from the offset from on and then
+// follows the tail of the log until the client goes away, like ConsumeStream.
+// Clients that accept text/event-stream get Server-Sent Events with the offset
+// as event id, so Last-Event-ID resumes after it, the others get a
+// ConsumeResponse per line. An error after the records started ends the
+// stream with an error event or an ErrorResponse line.
+func (s *httpServer) handleConsumeStream(w http.ResponseWriter, r *http.Request) {
+	from, err := queryUint(r, "from", 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if id := r.Header.Get("Last-Event-ID"); sse && id != "" {
+		last, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "invalid Last-Event-ID %q", id))
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		from = last + 1
 	}
-	consumeResp := ConsumeResponse{
-		Record: rec,
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, status.Error(codes.Unimplemented, "streaming is not supported"))
+		return
 	}
-	err = json.NewEncoder(w).Encode(consumeResp)
+	clog, release, err := s.consumeLog(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	defer release()
 
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx := r.Context()
+	enc := json.NewEncoder(w)
+	for off := from; ; {
+		// fails once the client is gone or the log is closed
+		if err := clog.Wait(ctx, off); err != nil {
+			return
+		}
+		records, err := clog.ReadBatch(off, defaultFetchRecords, defaultFetchBytes)
+		if err != nil {
+			_, resp := errorResponse(err)
+			if sse {
+				fmt.Fprint(w, "event: error\ndata: ")
+			}
+			enc.Encode(resp)
+			if sse {
+				fmt.Fprint(w, "\n")
+			}
+			flusher.Flush()
+			return
+		}
+		if len(records) == 0 {
+			// off was appended and compacted since, as in Replicate
+			off++
+			continue
+		}
+		for _, record := range records {
+			if sse {
+				fmt.Fprintf(w, "id: %d\ndata: ", record.Offset)
+			}
+			if err := enc.Encode(ConsumeResponse{Record: record}); err != nil {
+				return
+			}
+			if sse {
+				fmt.Fprint(w, "\n")
+			}
+			off = record.Offset + 1
+		}
+		flusher.Flush()
 	}
-	return
 }
 
-func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
-	var produceRequest ProduceRequest
-	err := json.NewDecoder(r.Body).Decode(&produceRequest)
+// appended reports whether the record at off has been appended, even if it
+// was removed since.
+func appended(clog CommitLog, off uint64) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return clog.Wait(ctx, off) == nil
+}
 
+// consumeLog returns the log of the topic and partition a consume request is
+// meant for.
+func (s *httpServer) consumeLog(r *http.Request) (CommitLog, func(), error) {
+	topic := mux.Vars(r)["topic"]
+	partition, err := queryUint(r, "partition", 0)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, err
 	}
-	fmt.Println(*&produceRequest)
-	offs, err := s.log.Append(produceRequest.Record)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := s.authorize(r.Context(), topic, consumeAction); err != nil {
+		return nil, nil, err
 	}
-	produceResp := ProductResponse{Offset: offs}
-	err = json.NewEncoder(w).Encode(produceResp)
+	return s.commitLog(topic, uint32(partition))
+}
+
+func queryUint(r *http.Request, name string, def uint64) (uint64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, status.Errorf(codes.InvalidArgument, "invalid %s %q", name, v)
 	}
-	return
+	return n, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError maps the status of err to an HTTP status code, the typed errors
+// of the api package all carry one.
+func writeError(w http.ResponseWriter, err error) {
+	code, resp := errorResponse(err)
+	writeJSON(w, code, resp)
+}
+
+func errorResponse(err error) (int, ErrorResponse) {
+	st := status.Convert(err)
+	return httpStatus(st.Code()), ErrorResponse{
+		Code:    st.Code().String(),
+		Message: st.Message(),
+	}
+}
+
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.InvalidArgument, codes.OutOfRange, codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Canceled, codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
 }
 
 type ProduceRequest struct {
-	Record Record `json:"record"`
+	Record *api.Record `json:"record"`
 }
 
 type ProductResponse struct {
-	Offset uint64 `json:"offset"`
+	Offset    uint64 `json:"offset"`
+	Partition uint32 `json:"partition"`
 }
 
-type ConsumeRequest struct {
-	Offset uint64 `json:"offset"`
+type ConsumeResponse struct {
+	Record *api.Record `json:"record"`
 }
 
-type ConsumeResponse struct {
-	Record Record `json:"record"`
+type RecordsResponse struct {
+	Records []*api.Record `json:"records"`
+	// Next is the offset the next page starts from.
+	Next uint64 `json:"next"`
+}
+
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"github.com/abdelwhab-1/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPServer(t *testing.T) {
+	for scenario, newLog := range map[string]func(t *testing.T) CommitLog{
+		"in memory": func(t *testing.T) CommitLog { return NewLog() },
+		"on disk": func(t *testing.T) CommitLog {
+			clog, err := log.NewLog(t.TempDir(), log.Config{})
+			require.NoError(t, err)
+			t.Cleanup(func() { clog.Close() })
+			return clog
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			topics, err := log.NewTopics(t.TempDir(), log.Config{}, 0)
+			require.NoError(t, err)
+			defer topics.Close()
+			require.NoError(t, topics.Create("orders", 1))
+			clog := newLog(t)
+			handler := NewHTTPServer(":0", &Config{CommitLog: clog, Topics: topicManager{topics}}).Handler
+
+			do := func(method, target string, body interface{}, resp interface{}) int {
+				var b []byte
+				if body != nil {
+					b, err = json.Marshal(body)
+					require.NoError(t, err)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewReader(b)))
+				require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+				if resp != nil {
+					require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+				}
+				return w.Code
+			}
+
+			for _, prefix := range []string{"/topics/orders", ""} {
+				for i := 0; i < 3; i++ {
+					var produce ProductResponse
+					code := do(http.MethodPost, prefix+"/records", ProduceRequest{Record: &api.Record{Value: []byte(fmt.Sprint(i))}}, &produce)
+					require.Equal(t, http.StatusCreated, code)
+					require.Equal(t, uint64(i), produce.Offset)
+				}
+
+				var consume ConsumeResponse
+				require.Equal(t, http.StatusOK, do(http.MethodGet, prefix+"/records/1", nil, &consume))
+				require.Equal(t, []byte("1"), consume.Record.Value)
+
+				var page RecordsResponse
+				require.Equal(t, http.StatusOK, do(http.MethodGet, prefix+"/records?from=1&limit=1", nil, &page))
+				require.Len(t, page.Records, 1)
+				require.Equal(t, uint64(2), page.Next)
+				require.Equal(t, http.StatusOK, do(http.MethodGet, prefix+"/records?from=2", nil, &page))
+				require.Len(t, page.Records, 1)
+				require.Equal(t, uint64(3), page.Next)
+				// the end of the log is an empty page
+				require.Equal(t, http.StatusOK, do(http.MethodGet, prefix+"/records?from=3", nil, &page))
+				require.Empty(t, page.Records)
+				require.Equal(t, uint64(3), page.Next)
+
+				var errResp ErrorResponse
+				require.Equal(t, http.StatusNotFound, do(http.MethodGet, prefix+"/records/3", nil, &errResp))
+				require.Equal(t, "NotFound", errResp.Code)
+				require.Equal(t, http.StatusBadRequest, do(http.MethodGet, prefix+"/records?from=x", nil, &errResp))
+				require.Equal(t, "InvalidArgument", errResp.Code)
+			}
+
+			// records produced over HTTP are in the commit log
+			record, err := clog.Read(2)
+			require.NoError(t, err)
+			require.Equal(t, []byte("2"), record.Value)
+
+			var errResp ErrorResponse
+			require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/topics/payments/records/0", nil, &errResp))
+			require.Equal(t, "NotFound", errResp.Code)
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/records", strings.NewReader("{")))
+			require.Equal(t, http.StatusBadRequest, w.Code)
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&errResp))
+			require.Equal(t, "InvalidArgument", errResp.Code)
+		})
+	}
+}
+
+func TestHTTPConsumeRangeRetention(t *testing.T) {
+	c := log.Config{}
+	c.Sagment.MaxStoreBytes = 32
+	c.Retention.MaxBytes = 64
+	c.Retention.MinSegments = 1
+	c.Retention.CheckInterval = 10 * time.Millisecond
+	clog, err := log.NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer clog.Close()
+	for i := 0; i < 5; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		_, err := clog.Read(0)
+		return err != nil
+	}, 3*time.Second, 10*time.Millisecond)
+	handler := NewHTTPServer(":0", &Config{CommitLog: clog}).Handler
+	get := func(target string, resp interface{}) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+		return w.Code
+	}
+
+	// records removed by retention are not an empty page
+	var errResp ErrorResponse
+	require.Equal(t, http.StatusNotFound, get("/records?from=0", &errResp))
+	require.Equal(t, "NotFound", errResp.Code)
+
+	var page RecordsResponse
+	require.Equal(t, http.StatusOK, get("/records?from=4", &page))
+	require.Len(t, page.Records, 1)
+	require.Equal(t, uint64(5), page.Next)
+	require.Equal(t, http.StatusOK, get("/records?from=5", &page))
+	require.Empty(t, page.Records)
+	require.Equal(t, uint64(5), page.Next)
+}
+
+func TestHTTPConsumeCompacted(t *testing.T) {
+	clog := NewLog()
+	for i := 0; i < 3; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	clog.compact(2)
+	srv := httptest.NewServer(NewHTTPServer(":0", &Config{CommitLog: clog}).Handler)
+	defer srv.Close()
+
+	// a page of compacted records moves past them
+	var page RecordsResponse
+	resp, err := http.Get(srv.URL + "/records?from=2")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+	resp.Body.Close()
+	require.Empty(t, page.Records)
+	require.Equal(t, uint64(3), page.Next)
+
+	// and a stream waits for the next record
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/records/stream?from=2", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	_, err = clog.Append(&api.Record{Value: []byte("3")})
+	require.NoError(t, err)
+	var consume ConsumeResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&consume))
+	require.Equal(t, uint64(3), consume.Record.Offset)
+}
+
+func TestHTTPConsumeStream(t *testing.T) {
+	for scenario, accept := range map[string]string{
+		"server-sent events":     "text/event-stream",
+		"newline-delimited json": "application/x-ndjson",
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			clog := NewLog()
+			_, err := clog.Append(&api.Record{Value: []byte("0")})
+			require.NoError(t, err)
+			handler := NewHTTPServer(":0", &Config{CommitLog: clog}).Handler
+			done := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handler.ServeHTTP(w, r)
+				if strings.HasSuffix(r.URL.Path, "/stream") {
+					close(done)
+				}
+			}))
+			defer srv.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/records/stream?from=0", nil)
+			require.NoError(t, err)
+			req.Header.Set("Accept", accept)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, accept, resp.Header.Get("Content-Type"))
+
+			lines := bufio.NewReader(resp.Body)
+			next := func() *api.Record {
+				line, err := lines.ReadString('\n')
+				require.NoError(t, err)
+				if accept == "text/event-stream" {
+					require.True(t, strings.HasPrefix(line, "id: "), line)
+					line, err = lines.ReadString('\n')
+					require.NoError(t, err)
+					require.True(t, strings.HasPrefix(line, "data: "), line)
+					line = strings.TrimPrefix(line, "data: ")
+					blank, err := lines.ReadString('\n')
+					require.NoError(t, err)
+					require.Equal(t, "\n", blank)
+				}
+				var consume ConsumeResponse
+				require.NoError(t, json.Unmarshal([]byte(line), &consume))
+				return consume.Record
+			}
+
+			require.Equal(t, []byte("0"), next().Value)
+			// the stream follows the tail of the log
+			for i := 1; i < 3; i++ {
+				_, err := clog.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+				require.NoError(t, err)
+				record := next()
+				require.Equal(t, uint64(i), record.Offset)
+				require.Equal(t, []byte(fmt.Sprint(i)), record.Value)
+			}
+
+			// and ends when the client goes away
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("stream didn't end after the client went away")
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+)
+
+// Log is an in-memory CommitLog for tests that don't need the disk.
+type Log struct {
+	mu       sync.Mutex
+	records  []*api.Record
+	appended chan struct{}
+}
+
+func NewLog() *Log {
+	return &Log{appended: make(chan struct{})}
+}
+
+func (log *Log) Append(record *api.Record) (uint64, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.append(record), nil
+}
+
+func (log *Log) AppendBatch(records []*api.Record) (uint64, uint64, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	var first, last uint64
+	for i, record := range records {
+		last = log.append(record)
+		if i == 0 {
+			first = last
+		}
+	}
+	return first, last, nil
+}
+
+func (log *Log) append(record *api.Record) uint64 {
+	record.Offset = uint64(len(log.records))
+	log.records = append(log.records, record)
+	close(log.appended)
+	log.appended = make(chan struct{})
+	return record.Offset
+}
+
+// compact removes the record at offset, as compaction does when a later one
+// has the same key.
+func (log *Log) compact(offset uint64) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.records[offset] = nil
+}
+
+func (log *Log) Read(offset uint64) (*api.Record, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if offset >= uint64(len(log.records)) {
+		return nil, api.ErrOffsetOutOfRange{OffSet: offset}
+	}
+	if log.records[offset] == nil {
+		return nil, api.ErrOffsetCompacted{OffSet: offset}
+	}
+	return log.records[offset], nil
+}
+
+func (log *Log) ReadBatch(off uint64, max int, maxBytes uint64) ([]*api.Record, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if off >= uint64(len(log.records)) {
+		return nil, api.ErrOffsetOutOfRange{OffSet: off}
+	}
+	var (
+		records []*api.Record
+		size    uint64
+	)
+	for _, record := range log.records[off:] {
+		if record == nil {
+			continue
+		}
+		if len(records) == max || (len(records) > 0 && size+uint64(len(record.Value)) > maxBytes) {
+			break
+		}
+		size += uint64(len(record.Value))
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func (log *Log) OffsetForTime(t time.Time) (uint64, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	for _, record := range log.records {
+		if record != nil && record.Timestamp >= t.UnixNano() {
+			return record.Offset, nil
+		}
+	}
+	return uint64(len(log.records)), nil
+}
+
+func (log *Log) LowestOffset() (uint64, error) {
+	return 0, nil
+}
+
+func (log *Log) HighestOffset() (uint64, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if len(log.records) == 0 {
+		return 0, nil
+	}
+	return uint64(len(log.records)) - 1, nil
+}
+
+func (log *Log) Wait(ctx context.Context, off uint64) error {
+	for {
+		log.mu.Lock()
+		next, appended := uint64(len(log.records)), log.appended
+		log.mu.Unlock()
+		if off < next {
+			return nil
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
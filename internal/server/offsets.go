@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+)
+
+// OffsetLog is the log committed offsets are kept in. Every commit is a
+// record keyed by group, topic and partition, so a log with compaction
+// enabled only keeps the latest commit of each.
+type OffsetLog interface {
+	Append(*api.Record) (uint64, error)
+	Read(uint64) (*api.Record, error)
+	LowestOffset() (uint64, error)
+}
+
+// offsetStore keeps the committed offset of every consumer group in memory and
+// writes every commit through to its log.
+type offsetStore struct {
+	mu        sync.Mutex
+	log       OffsetLog
+	committed map[string]uint64
+}
+
+func newOffsetStore(log OffsetLog) (*offsetStore, error) {
+	s := &offsetStore{
+		log:       log,
+		committed: make(map[string]uint64),
+	}
+	off, err := log.LowestOffset()
+	if err != nil {
+		return nil, err
+	}
+	for ; ; off++ {
+		record, err := log.Read(off)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetCompacted:
+			continue
+		case api.ErrOffsetOutOfRange:
+			return s, nil
+		default:
+			return nil, err
+		}
+		if len(record.Value) != 8 {
+			continue
+		}
+		s.committed[string(record.Key)] = binary.BigEndian.Uint64(record.Value)
+	}
+}
+
+func offsetKey(group, topic string, partition uint32) string {
+	return strings.Join([]string{group, topic, strconv.FormatUint(uint64(partition), 10)}, "\x00")
+}
+
+// Commit durably records offset as the next offset group consumes from the
+// topic's partition.
+func (s *offsetStore) Commit(group, topic string, partition uint32, offset uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := offsetKey(group, topic, partition)
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, offset)
+	if _, err := s.log.Append(&api.Record{Key: []byte(key), Value: value}); err != nil {
+		return err
+	}
+	s.committed[key] = offset
+	return nil
+}
+
+// Fetch returns the offset last committed by group.
+func (s *offsetStore) Fetch(group, topic string, partition uint32) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, ok := s.committed[offsetKey(group, topic, partition)]
+	if !ok {
+		return 0, api.ErrNoCommittedOffset{Group: group, Topic: topic, Partition: partition}
+	}
+	return offset, nil
+}
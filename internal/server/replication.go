@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	replicateBatchRecords        = 500
+	replicateBatchBytes   uint64 = 1 << 20
+)
+
+// replicaSet tracks how far every connected follower has replicated the
+// default log.
+type replicaSet struct {
+	mu sync.Mutex
+	// acked holds the next offset each follower needs, everything before
+	// it has been appended to its log.
+	acked map[string]uint64
+	// changed is closed and replaced whenever a follower acknowledges.
+	changed chan struct{}
+}
+
+func newReplicaSet() *replicaSet {
+	return &replicaSet{
+		acked:   make(map[string]uint64),
+		changed: make(chan struct{}),
+	}
+}
+
+func (r *replicaSet) ack(id string, next uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.acked[id] = next
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+func (r *replicaSet) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.acked, id)
+}
+
+// wait blocks until n followers have everything before next or ctx is done.
+func (r *replicaSet) wait(ctx context.Context, next uint64, n int) error {
+	for {
+		r.mu.Lock()
+		count := 0
+		for _, acked := range r.acked {
+			if acked >= next {
+				count++
+			}
+		}
+		changed := r.changed
+		r.mu.Unlock()
+		if count >= n {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return status.Errorf(codes.DeadlineExceeded, "%d of %d followers acknowledged offset %d", count, n, next-1)
+		}
+	}
+}
+
+// replicaSet returns the followers of the default log, they are shared by
+// every server using conf so that the HTTP front end waits for the followers
+// connected to the gRPC one.
+func (conf *Config) replicaSet() *replicaSet {
+	conf.replicasOnce.Do(func() {
+		conf.replicas = newReplicaSet()
+	})
+	return conf.replicas
+}
+
+// waitReplicas applies ReplicaAcks to records appended to the default log up
+// to last.
+func (conf *Config) waitReplicas(ctx context.Context, topic string, last uint64) error {
+	if topic != "" || conf.ReplicaAcks == 0 {
+		return nil
+	}
+	if conf.ReplicaAckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.ReplicaAckTimeout)
+		defer cancel()
+	}
+	return conf.replicaSet().wait(ctx, last+1, conf.ReplicaAcks)
+}
+
+// Replicate streams the default log to a follower from the offset of its first
+// request on. Its later requests acknowledge what it has appended.
+func (srv *grpcServer) Replicate(stream api.Log_ReplicateServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.FollowerId == "" {
+		return status.Error(codes.InvalidArgument, "a follower id is required")
+	}
+	if srv.CommitLog == nil {
+		return status.Error(codes.FailedPrecondition, "there is no default log to replicate")
+	}
+	if err := srv.authorize(stream.Context(), "", consumeAction); err != nil {
+		return err
+	}
+	id := req.FollowerId
+	replicas := srv.replicaSet()
+	replicas.ack(id, req.OffSet)
+	defer replicas.remove(id)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			replicas.ack(id, req.OffSet)
+		}
+	}()
+
+	ctx := stream.Context()
+	next := req.OffSet
+	for {
+		if err := srv.CommitLog.Wait(ctx, next); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		// a follower behind what retention kept, a new one asks for 0,
+		// goes on from the oldest record left
+		lowest, err := srv.CommitLog.LowestOffset()
+		if err != nil {
+			return err
+		}
+		if next < lowest {
+			next = lowest
+		}
+		records, err := srv.CommitLog.ReadBatch(next, replicateBatchRecords, replicateBatchBytes)
+		if err != nil {
+			return err
+		}
+		highest, err := srv.CommitLog.HighestOffset()
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			// only compacted offsets were left up to the end of a segment
+			next++
+			continue
+		}
+		if err := stream.Send(&api.ReplicateResponse{Records: records, HighestOffSet: highest}); err != nil {
+			return err
+		}
+		next = records[len(records)-1].Offset + 1
+	}
+}
@@ -2,25 +2,134 @@ package server
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	api "github.com/abdelwhab-1/proglog/api/v1"
+	"github.com/abdelwhab-1/proglog/internal/config"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 type Config struct {
+	// CommitLog serves the requests that do not name a topic.
 	CommitLog CommitLog
+	Topics    TopicManager
+	// OffsetLog stores the offsets committed by consumer groups.
+	OffsetLog OffsetLog
+	// SessionTimeout is how long a group member may go without a heartbeat
+	// before its partitions are given to the others, 10 seconds by default.
+	SessionTimeout time.Duration
+	// ReplicaAcks is the number of followers that must have a record of
+	// the default log before producing it succeeds, waiting at most
+	// ReplicaAckTimeout when it is set.
+	ReplicaAcks       int
+	ReplicaAckTimeout time.Duration
+	// GetServerer lists the servers of the cluster for clients that balance
+	// their requests over them.
+	GetServerer GetServerer
+	// TLS makes the server only accept TLS connections, clients have to
+	// present a certificate signed by its CAFile when that is set.
+	TLS *config.TLSConfig
+	// Authorizer checks that the subject of a client's certificate may
+	// produce to, consume from or administer a topic, DefaultLogObject
+	// stands for the default log and TopicsObject for the list of topics.
+	// Every client is allowed everything when it is nil.
+	Authorizer Authorizer
+	// Proxies are the subjects that call on behalf of others, as the
+	// gateway does for HTTP clients. Their requests are authorized as the
+	// subject they forward, never as their own.
+	Proxies []string
+
+	replicasOnce sync.Once
+	replicas     *replicaSet
+}
+
+const (
+	// DefaultLogObject is the name of the default log in authorization
+	// policies, topic names cannot contain a slash.
+	DefaultLogObject = "/"
+	// TopicsObject is the list of topics, ListTopics needs admin on it.
+	TopicsObject  = "/topics"
+	produceAction = "produce"
+	consumeAction = "consume"
+	// adminAction creates and deletes topics and lists them.
+	adminAction = "admin"
+)
+
+type Authorizer interface {
+	Authorize(subject, object, action string) error
 }
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) (uint64, uint64, error)
 	Read(uint64) (*api.Record, error)
+	// ReadBatch reads up to max records taking about maxBytes from the
+	// offset on.
+	ReadBatch(off uint64, max int, maxBytes uint64) ([]*api.Record, error)
+	OffsetForTime(time.Time) (uint64, error)
+	// LowestOffset is the first offset retention has kept.
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	// Wait blocks until the record at the offset has been appended or the
+	// context is done.
+	Wait(context.Context, uint64) error
+}
+
+// TopicManager holds a commit log per partition of every named topic.
+type TopicManager interface {
+	Create(topic string, partitions uint32) error
+	Delete(topic string) error
+	List() ([]string, error)
+	Partitions(topic string) (uint32, error)
+	// Partition picks the partition a record with key is produced to.
+	Partition(topic string, key []byte) (uint32, error)
+	// Acquire returns the partition's log, it stays usable until release
+	// is called.
+	Acquire(topic string, partition uint32) (clog CommitLog, release func(), err error)
+}
+
+type GetServerer interface {
+	GetServers() ([]*api.Server, error)
 }
 
 var _ api.LogServer = (*grpcServer)(nil)
 
-func NewGRPCServer(config *Config) (*grpc.Server, error) {
-	gsrv := grpc.NewServer()
-	srv, err := newgrpcServer(config)
+func NewGRPCServer(conf *Config) (*grpc.Server, error) {
+	var opts []grpc.ServerOption
+	if conf.TLS != nil {
+		tlsConfig := *conf.TLS
+		tlsConfig.Server = true
+		serverTLS, err := config.SetupTLSConfig(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(serverTLS)))
+	}
+	opts = append(opts,
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := conf.authenticate(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := conf.authenticate(stream.Context())
+			if err != nil {
+				return err
+			}
+			return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+		}),
+	)
+	gsrv := grpc.NewServer(opts...)
+	srv, err := newgrpcServer(conf)
 	if err != nil {
 		return nil, err
 	}
@@ -31,28 +140,422 @@ func NewGRPCServer(config *Config) (*grpc.Server, error) {
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+	offsets     *offsetStore
+	coordinator *coordinator
 }
 
 func newgrpcServer(config *Config) (*grpcServer, error) {
 	srv := &grpcServer{Config: config}
+	sessionTimeout := config.SessionTimeout
+	if sessionTimeout == 0 {
+		sessionTimeout = 10 * time.Second
+	}
+	srv.coordinator = newCoordinator(sessionTimeout, srv.partitions)
+	if config.OffsetLog != nil {
+		offsets, err := newOffsetStore(config.OffsetLog)
+		if err != nil {
+			return nil, err
+		}
+		srv.offsets = offsets
+	}
 	return srv, nil
 }
 
+type subjectContextKey struct{}
+
+// subjectMetadata carries the subject a proxy calls on behalf of.
+const subjectMetadata = "proglog-subject"
+
+// authenticate adds the common name of the client's certificate to ctx, it is
+// empty for plaintext connections. A proxy gets the subject it forwards.
+func (conf *Config) authenticate(ctx context.Context) (context.Context, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx, status.Error(codes.Unknown, "couldn't find peer info")
+	}
+	var subject string
+	if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+		subject = tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+	}
+	if subject != "" && conf.proxy(subject) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		forwarded := md.Get(subjectMetadata)
+		if len(forwarded) != 1 {
+			return ctx, status.Errorf(codes.Unauthenticated, "proxy %q forwarded %d subjects", subject, len(forwarded))
+		}
+		subject = forwarded[0]
+	}
+	return context.WithValue(ctx, subjectContextKey{}, subject), nil
+}
+
+func (conf *Config) proxy(subject string) bool {
+	for _, proxy := range conf.Proxies {
+		if proxy == subject {
+			return true
+		}
+	}
+	return false
+}
+
+func subject(ctx context.Context) string {
+	subject, _ := ctx.Value(subjectContextKey{}).(string)
+	return subject
+}
+
+// authenticatedStream carries the context authenticate returned.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (conf *Config) authorize(ctx context.Context, topic, action string) error {
+	if conf.Authorizer == nil {
+		return nil
+	}
+	object := topic
+	if object == "" {
+		object = DefaultLogObject
+	}
+	return conf.Authorizer.Authorize(subject(ctx), object, action)
+}
+
+// commitLog resolves the log a request is meant for.
+func (conf *Config) commitLog(topic string, partition uint32) (CommitLog, func(), error) {
+	if topic == "" {
+		if conf.CommitLog == nil {
+			return nil, nil, status.Error(codes.InvalidArgument, "a topic is required")
+		}
+		return conf.CommitLog, func() {}, nil
+	}
+	if conf.Topics == nil {
+		return nil, nil, status.Error(codes.Unimplemented, "topics are not enabled")
+	}
+	return conf.Topics.Acquire(topic, partition)
+}
+
+// partitions returns the number of partitions of topic, the default log is a
+// single partition.
+func (conf *Config) partitions(topic string) (uint32, error) {
+	if topic == "" {
+		if conf.CommitLog == nil {
+			return 0, status.Error(codes.InvalidArgument, "a topic is required")
+		}
+		return 1, nil
+	}
+	if conf.Topics == nil {
+		return 0, status.Error(codes.Unimplemented, "topics are not enabled")
+	}
+	return conf.Topics.Partitions(topic)
+}
+
+// route picks the partition for a record produced to topic and returns its log.
+func (conf *Config) route(topic string, key []byte) (CommitLog, uint32, func(), error) {
+	var partition uint32
+	if topic != "" && conf.Topics != nil {
+		var err error
+		if partition, err = conf.Topics.Partition(topic, key); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+	clog, release, err := conf.commitLog(topic, partition)
+	return clog, partition, release, err
+}
+
+// batchKey returns the key a batch is routed by. A batch goes to a single
+// partition, so the records with a key must all hash to the same one, the
+// others follow them.
+func (conf *Config) batchKey(topic string, records []*api.Record) ([]byte, error) {
+	if topic == "" || conf.Topics == nil {
+		return nil, nil
+	}
+	var key []byte
+	var partition uint32
+	for _, record := range records {
+		if len(record.Key) == 0 {
+			continue
+		}
+		p, err := conf.Topics.Partition(topic, record.Key)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			key, partition = record.Key, p
+			continue
+		}
+		if p != partition {
+			return nil, status.Errorf(codes.InvalidArgument, "keys %q and %q of the batch hash to different partitions", key, record.Key)
+		}
+	}
+	return key, nil
+}
+
 func (srv *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	offset, err := srv.CommitLog.Append(req.Record)
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "record is required")
+	}
+	if err := srv.authorize(ctx, req.Topic, produceAction); err != nil {
+		return nil, err
+	}
+	clog, partition, release, err := srv.route(req.Topic, req.Record.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	offset, err := clog.Append(req.Record)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.waitReplicas(ctx, req.Topic, offset); err != nil {
+		return nil, err
+	}
+	return &api.ProduceResponse{OffSet: offset, Partition: partition}, nil
+}
+func (srv *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "batch has no records")
+	}
+	if err := srv.authorize(ctx, req.Topic, produceAction); err != nil {
+		return nil, err
+	}
+	key, err := srv.batchKey(req.Topic, req.Records)
+	if err != nil {
+		return nil, err
+	}
+	clog, partition, release, err := srv.route(req.Topic, key)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	first, last, err := clog.AppendBatch(req.Records)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.waitReplicas(ctx, req.Topic, last); err != nil {
+		return nil, err
+	}
+	return &api.ProduceBatchResponse{FirstOffSet: first, LastOffSet: last, Partition: partition}, nil
+}
+
+func (srv *grpcServer) OffsetsForTimes(ctx context.Context, req *api.OffsetsForTimesRequest) (*api.OffsetsForTimesResponse, error) {
+	if err := srv.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	clog, release, err := srv.commitLog(req.Topic, req.Partition)
 	if err != nil {
 		return nil, err
 	}
-	return &api.ProduceResponse{OffSet: offset}, nil
+	defer release()
+	res := &api.OffsetsForTimesResponse{OffSets: make([]uint64, len(req.Timestamps))}
+	for i, ts := range req.Timestamps {
+		off, err := clog.OffsetForTime(time.Unix(0, ts))
+		if err != nil {
+			return nil, err
+		}
+		res.OffSets[i] = off
+	}
+	return res, nil
 }
+
 func (srv *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	record, err := srv.CommitLog.Read(req.OffSet)
+	if err := srv.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	clog, release, err := srv.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if req.MaxWaitMs > 0 {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(req.MaxWaitMs)*time.Millisecond)
+		defer cancel()
+		// the read below reports the offset as out of range when the wait
+		// times out
+		_ = clog.Wait(ctx, req.OffSet)
+	}
+	record, err := clog.Read(req.OffSet)
 	if err != nil {
 		return nil, err
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
+const (
+	defaultFetchRecords        = 500
+	defaultFetchBytes   uint64 = 1 << 20
+)
+
+func (srv *grpcServer) Fetch(ctx context.Context, req *api.FetchRequest) (*api.FetchResponse, error) {
+	if err := srv.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	clog, release, err := srv.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if req.MaxWaitMs > 0 {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(req.MaxWaitMs)*time.Millisecond)
+		defer cancel()
+		_ = clog.Wait(ctx, req.OffSet)
+	}
+	max := int(req.MaxRecords)
+	if max == 0 {
+		max = defaultFetchRecords
+	}
+	maxBytes := req.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultFetchBytes
+	}
+	records, err := clog.ReadBatch(req.OffSet, max, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	res := &api.FetchResponse{Records: records, NextOffSet: req.OffSet}
+	if len(records) > 0 {
+		res.NextOffSet = records[len(records)-1].Offset + 1
+	}
+	return res, nil
+}
+
+// GetServers is not authorized, every client balancing its requests over the
+// cluster needs the list whatever it may do.
+func (srv *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	if srv.GetServerer == nil {
+		return nil, status.Error(codes.Unimplemented, "the server is not part of a cluster")
+	}
+	servers, err := srv.GetServerer.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+func (srv *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (*api.CreateTopicResponse, error) {
+	if err := srv.authorize(ctx, req.Topic, adminAction); err != nil {
+		return nil, err
+	}
+	if srv.Topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not enabled")
+	}
+	if err := srv.Topics.Create(req.Topic, req.Partitions); err != nil {
+		return nil, err
+	}
+	return &api.CreateTopicResponse{}, nil
+}
+
+func (srv *grpcServer) DeleteTopic(ctx context.Context, req *api.DeleteTopicRequest) (*api.DeleteTopicResponse, error) {
+	if err := srv.authorize(ctx, req.Topic, adminAction); err != nil {
+		return nil, err
+	}
+	if srv.Topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not enabled")
+	}
+	if err := srv.Topics.Delete(req.Topic); err != nil {
+		return nil, err
+	}
+	return &api.DeleteTopicResponse{}, nil
+}
+
+func (srv *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (*api.ListTopicsResponse, error) {
+	if err := srv.authorize(ctx, TopicsObject, adminAction); err != nil {
+		return nil, err
+	}
+	if srv.Topics == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not enabled")
+	}
+	topics, err := srv.Topics.List()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListTopicsResponse{Topics: topics}, nil
+}
+
+// CommitOffset records the progress of a consumer, it needs consume on the
+// topic like FetchCommittedOffset.
+func (srv *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if err := srv.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	if srv.offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "consumer groups are not enabled")
+	}
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "a group is required")
+	}
+	if err := srv.offsets.Commit(req.Group, req.Topic, req.Partition, req.OffSet); err != nil {
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (srv *grpcServer) FetchCommittedOffset(ctx context.Context, req *api.FetchCommittedOffsetRequest) (*api.FetchCommittedOffsetResponse, error) {
+	if err := srv.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	if srv.offsets == nil {
+		return nil, status.Error(codes.Unimplemented, "consumer groups are not enabled")
+	}
+	offset, err := srv.offsets.Fetch(req.Group, req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FetchCommittedOffsetResponse{OffSet: offset}, nil
+}
+
+// JoinGroup keeps the caller in the group for as long as the stream is open
+// and sends it a new assignment every time the group is rebalanced. The caller
+// needs consume on every topic it subscribes to.
+func (srv *grpcServer) JoinGroup(req *api.JoinGroupRequest, stream api.Log_JoinGroupServer) error {
+	if req.Group == "" {
+		return status.Error(codes.InvalidArgument, "a group is required")
+	}
+	for _, topic := range req.Topics {
+		if err := srv.authorize(stream.Context(), topic, consumeAction); err != nil {
+			return err
+		}
+	}
+	member, err := srv.coordinator.Join(req.Group, req.MemberId, req.Topics, req.Strategy)
+	if err != nil {
+		return err
+	}
+	defer srv.coordinator.Leave(req.Group, member)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-member.expired:
+			return status.Errorf(codes.FailedPrecondition, "member %q left group %q", member.id, req.Group)
+		case assignment := <-member.assignments:
+			if err := stream.Send(assignment); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Heartbeat needs consume on the topics the member subscribed to, as joining
+// did.
+func (srv *grpcServer) Heartbeat(ctx context.Context, req *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
+	topics, err := srv.coordinator.Topics(req.Group, req.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	for _, topic := range topics {
+		if err := srv.authorize(ctx, topic, consumeAction); err != nil {
+			return nil, err
+		}
+	}
+	generation, err := srv.coordinator.Heartbeat(req.Group, req.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	return &api.HeartbeatResponse{Generation: generation}, nil
+}
+
 func (srv *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -69,24 +572,104 @@ func (srv *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	}
 }
 
+// ConsumeStream follows the log from the requested offset and blocks while
+// there is nothing new to send. With minBytes set, records are held back until
+// they add up to minBytes or maxWait has passed since the first of them.
 func (srv *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
-	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
+	if err := srv.authorize(stream.Context(), req.Topic, consumeAction); err != nil {
+		return err
+	}
+	if req.Group != "" && srv.offsets != nil {
+		offset, err := srv.offsets.Fetch(req.Group, req.Topic, req.Partition)
+		switch err.(type) {
+		case nil:
+			req.OffSet = offset
+		case api.ErrNoCommittedOffset:
 		default:
-			res, err := srv.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
-				return err
+			return err
+		}
+	}
+	clog, release, err := srv.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ctx := stream.Context()
+	for {
+		batch, err := gather(ctx, clog, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
 			}
-			if err := stream.Send(res); err != nil {
+			return err
+		}
+		for _, record := range batch {
+			if err := stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
 				return err
 			}
+		}
+	}
+}
+
+// gather blocks until the record at req.OffSet is appended and reads the
+// records from there on, waiting for more of them while they are fewer than
+// req.MinBytes. The batch ends once it has req.MinBytes, or the fetch defaults
+// without it, so that a consumer far behind is not read into memory at once.
+// req.OffSet is moved past the records returned.
+func gather(ctx context.Context, clog CommitLog, req *api.ConsumeRequest) ([]*api.Record, error) {
+	if err := clog.Wait(ctx, req.OffSet); err != nil {
+		return nil, err
+	}
+	wait := ctx
+	if req.MaxWaitMs > 0 {
+		var cancel context.CancelFunc
+		wait, cancel = context.WithTimeout(ctx, time.Duration(req.MaxWaitMs)*time.Millisecond)
+		defer cancel()
+	}
+	var batch []*api.Record
+	var size uint64
+	// ready is set while req.OffSet is known to have been appended
+	ready := true
+	for {
+		record, err := clog.Read(req.OffSet)
+		switch err.(type) {
+		case nil:
+			batch = append(batch, record)
+			size += uint64(proto.Size(record))
 			req.OffSet++
+			ready = false
+			if full(req.MinBytes, len(batch), size) {
+				return batch, nil
+			}
+			continue
+		case api.ErrOffsetCompacted:
+			req.OffSet++
+			ready = false
+			continue
+		case api.ErrOffsetOutOfRange:
+			if ready {
+				// retention removed the offset after it was appended
+				return nil, err
+			}
+		default:
+			return nil, err
 		}
+		if size >= req.MinBytes {
+			return batch, nil
+		}
+		if err := clog.Wait(wait, req.OffSet); err != nil {
+			if ctx.Err() == nil && wait.Err() != nil {
+				return batch, nil
+			}
+			return nil, err
+		}
+		ready = true
+	}
+}
+
+func full(minBytes uint64, records int, size uint64) bool {
+	if minBytes > 0 {
+		return size >= minBytes
 	}
+	return records >= defaultFetchRecords || size >= defaultFetchBytes
 }
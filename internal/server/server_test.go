@@ -1,15 +1,27 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	api "github.com/abdelwhab-1/proglog/api/v1"
+	"github.com/abdelwhab-1/proglog/internal/auth"
+	"github.com/abdelwhab-1/proglog/internal/config"
 	"github.com/abdelwhab-1/proglog/internal/log"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestServer(t *testing.T) {
@@ -17,6 +29,14 @@ func TestServer(t *testing.T) {
 		"produce/consume a message to/from the log succeeeds": testProduceConsume,
 		"produce/consume stream succeeds":                     testProduceConsumeStream,
 		"consume past log boundary fails":                     testConsumePastBoundary,
+		"produce a batch of messages succeeds":                testProduceBatch,
+		"offsets for times":                                   testOffsetsForTimes,
+		"produce/consume to named topics":                     testTopics,
+		"produce routes records to partitions":                testPartitions,
+		"consumer group offsets are committed":                testCommittedOffsets,
+		"group members share the partitions":                  testJoinGroup,
+		"consumers wait for new records":                      testLongPoll,
+		"fetch returns many records at once":                  testFetch,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			client, config, teardown := setupTest(t, nil)
@@ -27,13 +47,133 @@ func TestServer(t *testing.T) {
 	}
 }
 
+func TestReplication(t *testing.T) {
+	client, config, teardown := setupTest(t, func(conf *Config) {
+		conf.ReplicaAcks = 1
+		conf.ReplicaAckTimeout = 200 * time.Millisecond
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// without a follower nothing is acknowledged
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("first")}})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	dir, err := ioutil.TempDir("", "server-follower-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	local, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer local.Close()
+	follower := NewFollower("follower-1", local, client)
+
+	produced, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: []*api.Record{
+		{Value: []byte("second")}, {Value: []byte("third")},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), produced.LastOffSet)
+	// the batch was acknowledged, so the follower has it
+	for off, want := range []string{"first", "second", "third"} {
+		leader, err := config.CommitLog.Read(uint64(off))
+		require.NoError(t, err)
+		record, err := follower.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+		require.Equal(t, leader.Timestamp, record.Timestamp)
+	}
+	require.Equal(t, uint64(0), follower.Lag())
+
+	// the follower serves reads and refuses writes
+	replica, err := newgrpcServer(&Config{CommitLog: follower})
+	require.NoError(t, err)
+	consume, err := replica.Consume(ctx, &api.ConsumeRequest{OffSet: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("second"), consume.Record.Value)
+	_, err = replica.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("refused")}})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// a restarted follower resumes from the end of its log
+	require.NoError(t, follower.Close())
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("fourth")}})
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	// producing over HTTP waits for the same followers
+	handler := NewHTTPServer(":0", config).Handler
+	httpProduce := func(value string) int {
+		b, err := json.Marshal(ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/records", bytes.NewReader(b)))
+		return w.Code
+	}
+	require.Equal(t, http.StatusGatewayTimeout, httpProduce("fifth"))
+	follower = NewFollower("follower-1", local, client)
+	defer follower.Close()
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("sixth")}})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, httpProduce("seventh"))
+	for off, want := range []string{"fourth", "fifth", "sixth", "seventh"} {
+		record, err := follower.Read(uint64(off + 3))
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+	}
+}
+
+func TestReplicationRetention(t *testing.T) {
+	c := log.Config{}
+	c.Sagment.MaxStoreBytes = 32
+	c.Retention.MaxBytes = 64
+	c.Retention.MinSegments = 1
+	c.Retention.CheckInterval = 10 * time.Millisecond
+	leader, err := log.NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer leader.Close()
+	client, _, teardown := setupTest(t, func(conf *Config) {
+		conf.CommitLog = leader
+		conf.ReplicaAcks = 1
+		conf.ReplicaAckTimeout = 2 * time.Second
+	})
+	defer teardown()
+	for i := 0; i < 5; i++ {
+		_, err := leader.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		_, err := leader.Read(0)
+		return err != nil
+	}, 3*time.Second, 10*time.Millisecond)
+	lowest, err := leader.LowestOffset()
+	require.NoError(t, err)
+
+	// a new follower asks for offset 0 and starts from what retention kept
+	local, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer local.Close()
+	follower := NewFollower("follower-1", local, client)
+	defer follower.Close()
+	produced, err := client.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("5")}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), produced.OffSet)
+	for off := lowest; off <= 5; off++ {
+		record, err := follower.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(off), string(record.Value))
+	}
+}
+
 func setupTest(t *testing.T, fn func(conf *Config)) (api.LogClient, *Config, func()) {
 	t.Helper()
 	// have a listner to listen to free port
-	l, err := net.Listen("tcp", ":0")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	require.NoError(t, err)
+	caFile, certs := setupCerts(t)
 	// create a grpc client that will listen to the same port as  L
-	clientOptions := []grpc.DialOption{grpc.WithInsecure()}
+	clientCreds, err := config.ClientCredentials(config.TLSConfig{
+		CertFile: certs["client"].CertFile,
+		KeyFile:  certs["client"].KeyFile,
+		CAFile:   caFile,
+	})
+	require.NoError(t, err)
+	clientOptions := []grpc.DialOption{grpc.WithTransportCredentials(clientCreds)}
 	client_con, err := grpc.Dial(l.Addr().String(), clientOptions...)
 	require.NoError(t, err)
 	// create new temp dir to use as a dir for a temp log from log package
@@ -43,9 +183,25 @@ func setupTest(t *testing.T, fn func(conf *Config)) (api.LogClient, *Config, fun
 	cLog, err := log.NewLog(dir, log.Config{})
 	require.NoError(t, err)
 
+	topics, err := log.NewTopics(dir+"-topics", log.Config{}, 0)
+	require.NoError(t, err)
+	offsetConfig := log.Config{}
+	offsetConfig.Compaction.Enabled = true
+	offsetDir, err := ioutil.TempDir("", "server-offsets-test")
+	require.NoError(t, err)
+	offsetLog, err := log.NewLog(offsetDir, offsetConfig)
+	require.NoError(t, err)
+
 	// create configuration to us to open a server
 	cfg := &Config{
 		CommitLog: cLog,
+		Topics:    topicManager{topics},
+		OffsetLog: offsetLog,
+		TLS: &config.TLSConfig{
+			CertFile: certs["server"].CertFile,
+			KeyFile:  certs["server"].KeyFile,
+			CAFile:   caFile,
+		},
 	}
 	require.NoError(t, err)
 
@@ -68,8 +224,203 @@ func setupTest(t *testing.T, fn func(conf *Config)) (api.LogClient, *Config, fun
 		client_con.Close()
 		l.Close()
 		cLog.Remove()
+		topics.Close()
+		os.RemoveAll(topics.Dir)
+		offsetLog.Close()
+		os.RemoveAll(offsetLog.Dir)
+	}
+
+}
+
+// setupCerts generates a certificate authority and the certificates of the
+// server and its clients.
+func setupCerts(t *testing.T) (string, map[string]config.CertFiles) {
+	t.Helper()
+	caFile, certs, err := config.GenerateCerts(t.TempDir(), "server", "client")
+	require.NoError(t, err)
+	return caFile, certs
+}
+
+func TestServerTLS(t *testing.T) {
+	caFile, certs := setupCerts(t)
+	dir := t.TempDir()
+	cLog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer cLog.Close()
+	srv, err := NewGRPCServer(&Config{
+		CommitLog: cLog,
+		TLS: &config.TLSConfig{
+			CertFile: certs["server"].CertFile,
+			KeyFile:  certs["server"].KeyFile,
+			CAFile:   caFile,
+		},
+	})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	produce := func(creds grpc.DialOption) error {
+		conn, err := grpc.Dial(l.Addr().String(), creds)
+		require.NoError(t, err)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err = api.NewLogClient(conn).Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("secret")}})
+		return err
+	}
+
+	// plaintext clients are refused
+	require.Error(t, produce(grpc.WithInsecure()))
+	// and so are clients without a certificate
+	anonymous, err := config.ClientCredentials(config.TLSConfig{CAFile: caFile})
+	require.NoError(t, err)
+	require.Error(t, produce(grpc.WithTransportCredentials(anonymous)))
+
+	client, err := config.ClientCredentials(config.TLSConfig{
+		CertFile: certs["client"].CertFile,
+		KeyFile:  certs["client"].KeyFile,
+		CAFile:   caFile,
+	})
+	require.NoError(t, err)
+	require.NoError(t, produce(grpc.WithTransportCredentials(client)))
+}
+
+func TestServerAuthorization(t *testing.T) {
+	caFile, certs, err := config.GenerateCerts(t.TempDir(), "server", "root", "nobody")
+	require.NoError(t, err)
+	policyFile := filepath.Join(t.TempDir(), "policy.csv")
+	policy := "p, root, /, produce\np, root, /, consume\n" +
+		"p, root, events, produce\np, root, events, consume\np, root, events, admin\n" +
+		"p, root, /topics, admin\n"
+	require.NoError(t, os.WriteFile(policyFile, []byte(policy), 0600))
+	authorizer, err := auth.New("", policyFile)
+	require.NoError(t, err)
+
+	cLog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer cLog.Close()
+	topics, err := log.NewTopics(t.TempDir(), log.Config{}, 0)
+	require.NoError(t, err)
+	defer topics.Close()
+	offsetLog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer offsetLog.Close()
+	srv, err := NewGRPCServer(&Config{
+		CommitLog: cLog,
+		Topics:    topicManager{topics},
+		OffsetLog: offsetLog,
+		TLS: &config.TLSConfig{
+			CertFile: certs["server"].CertFile,
+			KeyFile:  certs["server"].KeyFile,
+			CAFile:   caFile,
+		},
+		Authorizer: authorizer,
+	})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	newClient := func(name string) api.LogClient {
+		creds, err := config.ClientCredentials(config.TLSConfig{
+			CertFile: certs[name].CertFile,
+			KeyFile:  certs[name].KeyFile,
+			CAFile:   caFile,
+		})
+		require.NoError(t, err)
+		conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(creds))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return api.NewLogClient(conn)
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	root := newClient("root")
+	produce, err := root.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+	_, err = root.Consume(ctx, &api.ConsumeRequest{OffSet: produce.OffSet})
+	require.NoError(t, err)
+
+	nobody := newClient("nobody")
+	_, err = nobody.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobody.Consume(ctx, &api.ConsumeRequest{OffSet: produce.OffSet})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
 
+	produceStream, err := nobody.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, produceStream.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}}))
+	_, err = produceStream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	consumeStream, err := nobody.ConsumeStream(ctx, &api.ConsumeRequest{})
+	require.NoError(t, err)
+	_, err = consumeStream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// root joins a group nobody then heartbeats for
+	_, err = root.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "events", Partitions: 1})
+	require.NoError(t, err)
+	_, err = root.Produce(ctx, &api.ProduceRequest{Topic: "events", Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+	join, err := root.JoinGroup(ctx, &api.JoinGroupRequest{Group: "g", Topics: []string{"events"}})
+	require.NoError(t, err)
+	assignment, err := join.Recv()
+	require.NoError(t, err)
+	_, err = root.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "g", Topic: "events"})
+	require.NoError(t, err)
+
+	// every other RPC is refused to nobody and allowed to root
+	for name, call := range map[string]func(client api.LogClient) error{
+		"OffsetsForTimes": func(client api.LogClient) error {
+			_, err := client.OffsetsForTimes(ctx, &api.OffsetsForTimesRequest{Topic: "events", Timestamps: []int64{0}})
+			return err
+		},
+		"CreateTopic": func(client api.LogClient) error {
+			_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "events", Partitions: 1})
+			if status.Code(err) == codes.AlreadyExists {
+				return nil
+			}
+			return err
+		},
+		"ListTopics": func(client api.LogClient) error {
+			_, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+			return err
+		},
+		"CommitOffset": func(client api.LogClient) error {
+			_, err := client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "g", Topic: "events", OffSet: 1})
+			return err
+		},
+		"FetchCommittedOffset": func(client api.LogClient) error {
+			_, err := client.FetchCommittedOffset(ctx, &api.FetchCommittedOffsetRequest{Group: "g", Topic: "events"})
+			return err
+		},
+		"JoinGroup": func(client api.LogClient) error {
+			stream, err := client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "other", Topics: []string{"events"}})
+			if err != nil {
+				return err
+			}
+			defer stream.CloseSend()
+			_, err = stream.Recv()
+			return err
+		},
+		"Heartbeat": func(client api.LogClient) error {
+			_, err := client.Heartbeat(ctx, &api.HeartbeatRequest{Group: "g", MemberId: assignment.MemberId})
+			return err
+		},
+	} {
+		require.Equal(t, codes.PermissionDenied, status.Code(call(nobody)), name)
+		require.NoError(t, call(root), name)
+	}
+
+	_, err = nobody.DeleteTopic(ctx, &api.DeleteTopicRequest{Topic: "events"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = root.DeleteTopic(ctx, &api.DeleteTopicRequest{Topic: "events"})
+	require.NoError(t, err)
 }
 
 func testProduceConsume(t *testing.T, client api.LogClient, config *Config) {
@@ -136,3 +487,335 @@ func testConsumePastBoundary(t *testing.T, client api.LogClient, config *Config)
 	}
 
 }
+
+func testProduceBatch(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	records := []*api.Record{
+		{Value: []byte("first message")},
+		{Value: []byte("second message")},
+		{Value: []byte("third message")},
+	}
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.FirstOffSet)
+	require.Equal(t, uint64(len(records)-1), produce.LastOffSet)
+	for off := produce.FirstOffSet; off <= produce.LastOffSet; off++ {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{OffSet: off})
+		require.NoError(t, err)
+		require.Equal(t, records[off].Value, consume.Record.Value)
+	}
+
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testOffsetsForTimes(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	before := time.Now().UnixNano()
+	var stamps []int64
+	for i := 0; i < 3; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{OffSet: produce.OffSet})
+		require.NoError(t, err)
+		stamps = append(stamps, consume.Record.Timestamp)
+		time.Sleep(time.Millisecond)
+	}
+	res, err := client.OffsetsForTimes(ctx, &api.OffsetsForTimesRequest{
+		Timestamps: []int64{before, stamps[1], stamps[2] + 1},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 3}, res.OffSets)
+}
+
+func testTopics(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.Produce(ctx, &api.ProduceRequest{Topic: "payments", Record: &api.Record{Value: []byte("lost")}})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	for _, topic := range []string{"payments", "metrics"} {
+		_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: topic})
+		require.NoError(t, err)
+	}
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "metrics"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"metrics", "payments"}, list.Topics)
+
+	for _, topic := range list.Topics {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{Topic: topic, Record: &api.Record{Value: []byte(topic)}})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), produce.OffSet)
+	}
+	for _, topic := range list.Topics {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Topic: topic, OffSet: 0})
+		require.NoError(t, err)
+		require.Equal(t, []byte(topic), consume.Record.Value)
+	}
+	// the topics do not leak into the default log
+	_, err = client.Consume(ctx, &api.ConsumeRequest{OffSet: 0})
+	require.Error(t, err)
+
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Topic: "metrics"})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "metrics", OffSet: 0})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testPartitions(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "orders", Partitions: 4})
+	require.NoError(t, err)
+
+	// records with the same key stay in order on one partition
+	var keyed []*api.ProduceResponse
+	for i := 0; i < 3; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Topic:  "orders",
+			Record: &api.Record{Key: []byte("customer-1"), Value: []byte{byte(i)}},
+		})
+		require.NoError(t, err)
+		keyed = append(keyed, produce)
+	}
+	for i, produce := range keyed {
+		require.Equal(t, keyed[0].Partition, produce.Partition)
+		require.Equal(t, uint64(i), produce.OffSet)
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{
+			Topic: "orders", Partition: produce.Partition, OffSet: produce.OffSet,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i)}, consume.Record.Value)
+	}
+
+	// a batch goes to the partition of its keys, records without one follow
+	other := []byte("customer-2")
+	for i := 3; ; i++ {
+		p, err := config.Topics.Partition("orders", other)
+		require.NoError(t, err)
+		if p != keyed[0].Partition {
+			break
+		}
+		other = []byte(fmt.Sprintf("customer-%d", i))
+	}
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Topic: "orders", Records: []*api.Record{
+		{Value: []byte("no key")},
+		{Key: []byte("customer-1"), Value: []byte{3}},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, keyed[0].Partition, batch.Partition)
+	require.Equal(t, uint64(4), batch.LastOffSet)
+	// and keys of different partitions can't share a batch
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{Topic: "orders", Records: []*api.Record{
+		{Key: []byte("customer-1"), Value: []byte{5}},
+		{Key: other, Value: []byte{6}},
+	}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// records without a key are spread over every partition
+	seen := map[uint32]bool{}
+	for i := 0; i < 4; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Topic:  "orders",
+			Record: &api.Record{Value: []byte("no key")},
+		})
+		require.NoError(t, err)
+		seen[produce.Partition] = true
+	}
+	require.Equal(t, 4, len(seen))
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "orders", Partition: 4})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testCommittedOffsets(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	fetch := &api.FetchCommittedOffsetRequest{Group: "billing", Topic: "orders", Partition: 1}
+	_, err := client.FetchCommittedOffset(ctx, fetch)
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	for _, off := range []uint64{3, 7} {
+		_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{
+			Group: "billing", Topic: "orders", Partition: 1, OffSet: off,
+		})
+		require.NoError(t, err)
+	}
+	res, err := client.FetchCommittedOffset(ctx, fetch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), res.OffSet)
+
+	// the commits are read back from the offset log by a new server
+	srv, err := newgrpcServer(config)
+	require.NoError(t, err)
+	res, err = srv.FetchCommittedOffset(ctx, fetch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), res.OffSet)
+	_, err = srv.FetchCommittedOffset(ctx, &api.FetchCommittedOffsetRequest{Group: "billing", Topic: "orders"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// a stream for the group resumes from its committed offset
+	for _, value := range []string{"first", "second", "third"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+	}
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", OffSet: 2})
+	require.NoError(t, err)
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Group: "billing"})
+	require.NoError(t, err)
+	consume, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), consume.Record.Offset)
+	require.Equal(t, []byte("third"), consume.Record.Value)
+}
+
+func testJoinGroup(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Topic: "orders", Partitions: 4})
+	require.NoError(t, err)
+
+	join := func(ctx context.Context, member string) api.Log_JoinGroupClient {
+		stream, err := client.JoinGroup(ctx, &api.JoinGroupRequest{
+			Group: "billing", MemberId: member, Topics: []string{"orders"},
+		})
+		require.NoError(t, err)
+		return stream
+	}
+	recv := func(stream api.Log_JoinGroupClient) []uint32 {
+		assignment, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, "orders", assignment.Partitions[0].Topic)
+		return assignment.Partitions[0].Partitions
+	}
+
+	first := join(ctx, "first")
+	require.Equal(t, []uint32{0, 1, 2, 3}, recv(first))
+
+	secondCtx, leave := context.WithCancel(ctx)
+	second := join(secondCtx, "second")
+	require.Equal(t, []uint32{2, 3}, recv(second))
+	require.Equal(t, []uint32{0, 1}, recv(first))
+
+	res, err := client.Heartbeat(ctx, &api.HeartbeatRequest{Group: "billing", MemberId: "second"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Generation)
+
+	// the partitions of a member that leaves go back to the others
+	leave()
+	require.Equal(t, []uint32{0, 1, 2, 3}, recv(first))
+
+	missing, err := client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing", Topics: []string{"missing"}})
+	require.NoError(t, err)
+	_, err = missing.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testLongPoll(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	// a unary consume waits up to maxWait for the offset to be appended
+	_, err := client.Consume(ctx, &api.ConsumeRequest{OffSet: 0, MaxWaitMs: 10})
+	require.Equal(t, api.ErrOffsetOutOfRange{}.GRPCStatus().Code(), status.Code(err))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("late")}})
+	}()
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{OffSet: 0, MaxWaitMs: 5000})
+	require.NoError(t, err)
+	require.Equal(t, []byte("late"), consume.Record.Value)
+
+	// a stream holds small records back until they add up to minBytes
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.ConsumeStream(streamCtx, &api.ConsumeRequest{OffSet: 1, MinBytes: 64, MaxWaitMs: 5000})
+	require.NoError(t, err)
+	received := make(chan *api.Record, 8)
+	go func() {
+		for {
+			res, err := stream.Recv()
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- res.Record
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("small")}})
+		require.NoError(t, err)
+	}
+	select {
+	case <-received:
+		t.Fatal("records sent before minBytes were gathered")
+	case <-time.After(20 * time.Millisecond):
+	}
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: make([]byte, 64)}})
+	require.NoError(t, err)
+	for off := uint64(1); off <= 4; off++ {
+		record := <-received
+		require.Equal(t, off, record.Offset)
+	}
+
+	// cancelling an idle stream ends it
+	cancel()
+	_, open := <-received
+	require.False(t, open)
+}
+
+func TestGather(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	for i := 0; i < defaultFetchRecords+10; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte("record")})
+		require.NoError(t, err)
+	}
+	ctx := context.Background()
+
+	// without minBytes a batch stops at the fetch defaults
+	req := &api.ConsumeRequest{}
+	batch, err := gather(ctx, clog, req)
+	require.NoError(t, err)
+	require.Len(t, batch, defaultFetchRecords)
+	require.Equal(t, uint64(defaultFetchRecords), req.OffSet)
+	batch, err = gather(ctx, clog, req)
+	require.NoError(t, err)
+	require.Len(t, batch, 10)
+
+	// with it the batch stops once it has minBytes
+	req = &api.ConsumeRequest{MinBytes: 1}
+	batch, err = gather(ctx, clog, req)
+	require.NoError(t, err)
+	require.Len(t, batch, 1)
+	require.Equal(t, uint64(1), req.OffSet)
+}
+
+func testFetch(t *testing.T, client api.LogClient, config *Config) {
+	ctx := context.Background()
+	var records []*api.Record
+	for i := 0; i < 20; i++ {
+		records = append(records, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+	_, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+
+	var fetched []*api.Record
+	req := &api.FetchRequest{MaxRecords: 8}
+	for len(fetched) < len(records) {
+		res, err := client.Fetch(ctx, req)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(res.Records), 8)
+		fetched = append(fetched, res.Records...)
+		req.OffSet = res.NextOffSet
+	}
+	for i, record := range fetched {
+		require.Equal(t, uint64(i), record.Offset)
+		require.Equal(t, records[i].Value, record.Value)
+	}
+
+	res, err := client.Fetch(ctx, &api.FetchRequest{MaxBytes: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res.Records))
+	require.Equal(t, uint64(1), res.NextOffSet)
+
+	_, err = client.Fetch(ctx, &api.FetchRequest{OffSet: 20, MaxWaitMs: 10})
+	require.Equal(t, api.ErrOffsetOutOfRange{}.GRPCStatus().Code(), status.Code(err))
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"github.com/abdelwhab-1/proglog/internal/log"
+)
+
+// NewTopicManager serves the topics kept by a log.Topics.
+func NewTopicManager(topics *log.Topics) TopicManager {
+	return topicManager{topics}
+}
+
+// topicManager adapts log.Topics to the TopicManager interface.
+type topicManager struct {
+	*log.Topics
+}
+
+func (t topicManager) Acquire(topic string, partition uint32) (CommitLog, func(), error) {
+	clog, release, err := t.Topics.Acquire(topic, partition)
+	if err != nil {
+		return nil, nil, err
+	}
+	return clog, release, nil
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WSRequest is a frame sent by a WebSocket client, it carries one of the
+// requests.
+type WSRequest struct {
+	// Produce appends a record and is answered with a ProduceResponse once
+	// it is, the next frame is only read after that as with ProduceStream.
+	Produce *api.ProduceRequest `json:"produce,omitempty"`
+	// Consume subscribes to a partition from an offset on, its records are
+	// sent as they are appended as with ConsumeStream. Groups aren't
+	// supported.
+	Consume *api.ConsumeRequest `json:"consume,omitempty"`
+}
+
+// WSResponse is a frame sent to a WebSocket client. An error ends the
+// subscription it is about but not the connection.
+type WSResponse struct {
+	Produce *api.ProduceResponse `json:"produce,omitempty"`
+	Consume *api.ConsumeResponse `json:"consume,omitempty"`
+	Error   *ErrorResponse       `json:"error,omitempty"`
+}
+
+var upgrader = websocket.Upgrader{}
+
+const (
+	// wsMaxSubscriptions caps the subscriptions of a connection, each holds
+	// a goroutine and a log.
+	wsMaxSubscriptions = 16
+	// wsMaxMessageBytes caps the frames a client sends, as the gRPC server's
+	// default maximum receive message size caps its requests.
+	wsMaxMessageBytes = 4 << 20
+)
+
+var (
+	// wsWriteWait bounds every write, a client that stops reading is
+	// dropped once it has been reached.
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is how long a client has to answer a ping, pings are sent
+	// every wsPingPeriod.
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// handleWebSocket produces and consumes over a single connection. Frames are
+// written one at a time, so a client that doesn't keep up holds back its
+// subscriptions the way flow control does for the gRPC streams, until a write
+// takes longer than wsWriteWait. The connection is pinged and closed when the
+// client stops answering.
+func (s *httpServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied
+		return
+	}
+	var workers sync.WaitGroup
+	defer workers.Wait()
+	// closing the connection unblocks the subscriptions' writes
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var mu sync.Mutex
+	send := func(resp *WSResponse) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+			return err
+		}
+		return conn.WriteJSON(resp)
+	}
+
+	// a larger frame fails the read loop and closes the connection
+	conn.SetReadLimit(wsMaxMessageBytes)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		ticker := time.NewTicker(wsPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// the read loop fails once the pong is late
+				if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)) != nil {
+					return
+				}
+			}
+		}
+	}()
+	sendError := func(err error) error {
+		_, resp := errorResponse(err)
+		return send(&WSResponse{Error: &resp})
+	}
+	slots := make(chan struct{}, wsMaxSubscriptions)
+
+	for {
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req WSRequest
+		if err := json.Unmarshal(frame, &req); err != nil {
+			if sendError(status.Error(codes.InvalidArgument, err.Error())) != nil {
+				return
+			}
+			continue
+		}
+		switch {
+		case req.Produce != nil:
+			var resp *api.ProduceResponse
+			if resp, err = s.wsProduce(ctx, req.Produce); err == nil {
+				err = send(&WSResponse{Produce: resp})
+				if err != nil {
+					return
+				}
+			}
+		case req.Consume != nil:
+			select {
+			case slots <- struct{}{}:
+			default:
+				err = status.Errorf(codes.ResourceExhausted, "at most %d subscriptions per connection", wsMaxSubscriptions)
+			}
+			if err != nil {
+				break
+			}
+			var clog CommitLog
+			var release func()
+			clog, release, err = s.wsSubscribe(ctx, req.Consume)
+			if err != nil {
+				<-slots
+				break
+			}
+			workers.Add(1)
+			go func(req *api.ConsumeRequest) {
+				defer workers.Done()
+				defer func() { <-slots }()
+				defer release()
+				for {
+					batch, err := gather(ctx, clog, req)
+					if err != nil {
+						if ctx.Err() == nil {
+							sendError(err)
+						}
+						return
+					}
+					for _, record := range batch {
+						if send(&WSResponse{Consume: &api.ConsumeResponse{Record: record}}) != nil {
+							// a failed write leaves the connection
+							// unusable, this ends the read loop
+							conn.Close()
+							return
+						}
+					}
+				}
+			}(req.Consume)
+		default:
+			err = status.Error(codes.InvalidArgument, "frame has no request")
+		}
+		if err != nil && sendError(err) != nil {
+			return
+		}
+	}
+}
+
+func (s *httpServer) wsProduce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "record is required")
+	}
+	offs, partition, err := s.produce(ctx, req.Topic, req.Record)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceResponse{OffSet: offs, Partition: partition}, nil
+}
+
+func (s *httpServer) wsSubscribe(ctx context.Context, req *api.ConsumeRequest) (CommitLog, func(), error) {
+	if req.Group != "" {
+		return nil, nil, status.Error(codes.InvalidArgument, "groups are not supported over WebSocket")
+	}
+	if err := s.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, nil, err
+	}
+	return s.commitLog(req.Topic, req.Partition)
+}
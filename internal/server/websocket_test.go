@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/abdelwhab-1/proglog/api/v1"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocket(t *testing.T) {
+	clog := NewLog()
+	handler := NewHTTPServer(":0", &Config{CommitLog: clog}).Handler
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		close(done)
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	require.NoError(t, conn.WriteJSON(WSRequest{Consume: &api.ConsumeRequest{}}))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, conn.WriteJSON(WSRequest{Produce: &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(fmt.Sprint(i))},
+		}}))
+	}
+	// acks and records of the subscription come interleaved
+	var produced, consumed []uint64
+	for len(produced) < 3 || len(consumed) < 3 {
+		var resp WSResponse
+		require.NoError(t, conn.ReadJSON(&resp))
+		require.Nil(t, resp.Error)
+		switch {
+		case resp.Produce != nil:
+			produced = append(produced, resp.Produce.OffSet)
+		case resp.Consume != nil:
+			require.Equal(t, []byte(fmt.Sprint(len(consumed))), resp.Consume.Record.Value)
+			consumed = append(consumed, resp.Consume.Record.Offset)
+		}
+	}
+	require.Equal(t, []uint64{0, 1, 2}, produced)
+	require.Equal(t, []uint64{0, 1, 2}, consumed)
+
+	// bad frames are answered with an error and the connection stays open
+	for _, frame := range []string{"{", "{}", `{"produce":{}}`, `{"consume":{"topic":"orders"}}`} {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(frame)))
+		var resp WSResponse
+		require.NoError(t, conn.ReadJSON(&resp))
+		require.NotNil(t, resp.Error, frame)
+	}
+
+	require.NoError(t, conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler didn't return after the client closed")
+	}
+}
+
+func TestWebSocketLimits(t *testing.T) {
+	pongWait, pingPeriod := wsPongWait, wsPingPeriod
+	wsPongWait, wsPingPeriod = 200*time.Millisecond, 50*time.Millisecond
+	defer func() { wsPongWait, wsPingPeriod = pongWait, pingPeriod }()
+	handler := NewHTTPServer(":0", &Config{CommitLog: NewLog()}).Handler
+	returned := make(chan struct{}, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		returned <- struct{}{}
+	}))
+	defer srv.Close()
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		return conn
+	}
+	// the client answers pings while it reads
+	reader := func(conn *websocket.Conn) <-chan WSResponse {
+		frames := make(chan WSResponse)
+		go func() {
+			defer close(frames)
+			for {
+				var resp WSResponse
+				if conn.ReadJSON(&resp) != nil {
+					return
+				}
+				frames <- resp
+			}
+		}()
+		return frames
+	}
+
+	// subscriptions that failed don't count
+	conn := dial()
+	frames := reader(conn)
+	require.NoError(t, conn.WriteJSON(WSRequest{Consume: &api.ConsumeRequest{Topic: "orders"}}))
+	resp := <-frames
+	require.NotNil(t, resp.Error)
+	for i := 0; i < wsMaxSubscriptions; i++ {
+		require.NoError(t, conn.WriteJSON(WSRequest{Consume: &api.ConsumeRequest{}}))
+	}
+	require.NoError(t, conn.WriteJSON(WSRequest{Consume: &api.ConsumeRequest{}}))
+	resp = <-frames
+	require.Equal(t, "ResourceExhausted", resp.Error.Code)
+
+	// a client that keeps reading outlives the pong wait
+	time.Sleep(4 * wsPongWait)
+	require.NoError(t, conn.WriteJSON(WSRequest{Produce: &api.ProduceRequest{Record: &api.Record{Value: []byte("alive")}}}))
+	for resp = range frames {
+		if resp.Produce != nil {
+			break
+		}
+	}
+	require.NotNil(t, resp.Produce)
+
+	// a frame over the gRPC message size closes the connection
+	// instead of producing it, and the write may fail once the server
+	// stopped reading
+	large := dial()
+	large.WriteJSON(WSRequest{Produce: &api.ProduceRequest{Record: &api.Record{Value: make([]byte, wsMaxMessageBytes)}}})
+	_, _, err := large.ReadMessage()
+	require.Error(t, err)
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler didn't return after a frame over the limit")
+	}
+
+	// one that doesn't misses the pings and is disconnected
+	dial()
+	select {
+	case <-returned:
+	case <-time.After(4 * wsPongWait):
+		t.Fatal("handler didn't return after the client stopped answering pings")
+	}
+
+	// the first connection's handler reads the timeouts until it returns
+	conn.Close()
+	<-returned
+}